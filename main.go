@@ -1,9 +1,14 @@
 package main
 
 import (
+	"expvar"
 	"flag"
 	"fmt"
+	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/docker/docker/pkg/pidfile"
 	"github.com/docker/go-plugins-helpers/network"
@@ -26,19 +31,57 @@ const (
 
 `
 
-	defaultPidFile = "/var/run/onion.pid"
+	defaultPidFile     = "/var/run/onion.pid"
+	defaultRuntimeFile = "/var/run/onion.json"
 )
 
 var (
 	debug bool
 	vrsn  bool
 
-	pidFile string
+	pidFile         string
+	runtimeFile     string
+	firewallBackend string
+	metricsAddr     string
+
+	reconcileInterval   time.Duration
+	reconcileFailClosed bool
+	nflogGroup          uint
+
+	dryRun       bool
+	dryRunFormat string
+
+	transparentProxy bool
+	socksUpstream    string
+	dnsResolver      bool
+	i2pUpstream      string
+
+	auditLog           string
+	auditLogMaxSize    int64
+	auditLogMaxBackups int
+
+	accountingFile string
 )
 
 func init() {
 	// parse flags
 	flag.StringVar(&pidFile, "pidfile", defaultPidFile, "path to use for plugin's PID file")
+	flag.StringVar(&runtimeFile, "runtime-file", defaultRuntimeFile, "file the plugin records the settings its firewall depends on in, for verify to check the networks against")
+	flag.StringVar(&firewallBackend, "firewall-backend", tor.IptablesBackend, "backend used to program the firewall rules (iptables or nftables)")
+	flag.StringVar(&metricsAddr, "metrics-addr", "", "address to serve the metrics on at /debug/vars and the accounting of the endpoints on /accounting, disabled if empty")
+	flag.DurationVar(&reconcileInterval, "reconcile-interval", 30*time.Second, "how often to check the firewall rules for drift, 0 to disable")
+	flag.UintVar(&nflogGroup, "nflog-group", 0, "netlink log group to log the packets blocked from bypassing tor to and monitor, 0 to disable")
+	flag.BoolVar(&reconcileFailClosed, "reconcile-fail-closed", false, "take a network's bridge down when its firewall rules drifted instead of programming them again")
+	flag.BoolVar(&transparentProxy, "proxy", false, "relay the connections of the containers through the --socks-upstream instead of redirecting them to the tor router's TransPort")
+	flag.StringVar(&socksUpstream, "socks-upstream", "socks5://127.0.0.1:9050", "URL of the SOCKS5 proxy the connections are relayed through with --proxy and the names resolved through with --dns-resolver")
+	flag.BoolVar(&dnsResolver, "dns-resolver", false, "resolve the dns queries of the containers through the --socks-upstream instead of forwarding them to the tor router's DNSPort")
+	flag.StringVar(&i2pUpstream, "i2p-upstream", "http://127.0.0.1:4444", "URL of the HTTP or SOCKS5 proxy of the I2P router the connections to .i2p names are relayed through")
+	flag.StringVar(&auditLog, "audit-log", "", "file to log the dns queries and proxied connections of the containers to as JSON lines, disabled if empty")
+	flag.Int64Var(&auditLogMaxSize, "audit-log-max-size", 100, "size in megabytes the audit log is rotated at, 0 to never rotate it")
+	flag.IntVar(&auditLogMaxBackups, "audit-log-max-backups", 5, "number of rotated audit logs to keep")
+	flag.StringVar(&accountingFile, "accounting-file", "/var/lib/onion/accounting.json", "file to keep the connections and bytes the proxy relayed for each endpoint in across restarts, in memory only if empty")
+	flag.BoolVar(&dryRun, "dry-run", false, "print the changes the plugin would make to the host instead of making them")
+	flag.StringVar(&dryRunFormat, "dry-run-format", "text", "format of the changes printed in a dry run (text or json)")
 
 	flag.BoolVar(&vrsn, "version", false, "print version and exit")
 	flag.BoolVar(&vrsn, "v", false, "print version and exit (shorthand)")
@@ -46,6 +89,7 @@ func init() {
 
 	flag.Usage = func() {
 		fmt.Fprint(os.Stderr, fmt.Sprintf(BANNER, version.VERSION, version.GITCOMMIT))
+		fmt.Fprint(os.Stderr, "Usage: onion [flags] [verify]\n\n")
 		flag.PrintDefaults()
 	}
 
@@ -56,6 +100,14 @@ func init() {
 		os.Exit(0)
 	}
 
+	if dryRunFormat != "text" && dryRunFormat != "json" {
+		usageAndExit(fmt.Sprintf("unknown dry run format %q", dryRunFormat), 1)
+	}
+
+	if nflogGroup > 65535 {
+		usageAndExit(fmt.Sprintf("--nflog-group must be at most 65535, got %d", nflogGroup), 1)
+	}
+
 	// set log level
 	if debug {
 		logrus.SetLevel(logrus.DebugLevel)
@@ -63,6 +115,11 @@ func init() {
 }
 
 func main() {
+	if flag.Arg(0) == "verify" {
+		verify()
+		return
+	}
+
 	// setup the PID file if passed
 	if pidFile != "" {
 		pf, err := pidfile.New(pidFile)
@@ -77,12 +134,90 @@ func main() {
 		}()
 	}
 
-	d, err := tor.NewDriver()
+	config := tor.Config{
+		FirewallBackend:     firewallBackend,
+		ReconcileInterval:   reconcileInterval,
+		ReconcileFailClosed: reconcileFailClosed,
+		LeakMonitorGroup:    uint16(nflogGroup),
+		I2PUpstream:         i2pUpstream,
+		AccountingFile:      accountingFile,
+		RuntimeFile:         runtimeFile,
+	}
+	if transparentProxy {
+		config.ProxyUpstream = socksUpstream
+	}
+	if dnsResolver {
+		config.ResolverUpstream = socksUpstream
+	}
+	if auditLog != "" {
+		config.AuditLog = auditLog
+		config.AuditLogMaxSize = auditLogMaxSize << 20
+		config.AuditLogMaxBackups = auditLogMaxBackups
+	}
+	if dryRun {
+		config.DryRun = os.Stdout
+		config.DryRunJSON = dryRunFormat == "json"
+	}
+
+	d, err := tor.NewDriver(config)
 	if err != nil {
 		logrus.Fatal(err)
 	}
+
+	// serve the metrics if passed
+	if metricsAddr != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/debug/vars", expvar.Handler())
+		mux.Handle("/accounting", d.AccountingHandler())
+		go func() {
+			logrus.Fatal(http.ListenAndServe(metricsAddr, mux))
+		}()
+	}
+
 	h := network.NewHandler(d)
-	h.ServeUnix("tor", 0)
+	errc := make(chan error, 1)
+	go func() {
+		errc <- h.ServeUnix("tor", 0)
+	}()
+
+	// save the accounting on shutdown
+	sigc := make(chan os.Signal, 1)
+	signal.Notify(sigc, os.Interrupt, syscall.SIGTERM)
+	select {
+	case err := <-errc:
+		logrus.Errorf("Serving the plugin failed: %v", err)
+	case sig := <-sigc:
+		logrus.Infof("Received %s, shutting down", sig)
+	}
+	if err := d.Close(); err != nil {
+		logrus.Error(err)
+	}
+}
+
+// verify checks the tor networks for leaks and exits non-zero if it found
+// any. The settings of the running plugin are read from the runtime file,
+// the flags are only used with an empty --runtime-file.
+func verify() {
+	config := tor.Config{
+		FirewallBackend:  firewallBackend,
+		LeakMonitorGroup: uint16(nflogGroup),
+		I2PUpstream:      i2pUpstream,
+		RuntimeFile:      runtimeFile,
+	}
+	if transparentProxy {
+		config.ProxyUpstream = socksUpstream
+	}
+	if dnsResolver {
+		config.ResolverUpstream = socksUpstream
+	}
+
+	ok, err := tor.Verify(config, os.Stdout)
+	if err != nil {
+		logrus.Fatal(err)
+	}
+	if !ok {
+		os.Exit(1)
+	}
 }
 
 func usageAndExit(message string, exitCode int) {
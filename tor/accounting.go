@@ -0,0 +1,222 @@
+package tor
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+// endpointUsage is what an endpoint relayed through the transparent proxy.
+type endpointUsage struct {
+	Network       string `json:"network"`
+	Container     string `json:"container,omitempty"`
+	Connections   int64  `json:"connections"`
+	BytesSent     int64  `json:"bytes_sent"`
+	BytesReceived int64  `json:"bytes_received"`
+}
+
+// accounting keeps the usage of the endpoints, keyed by endpoint id, in a
+// file so it survives the plugin being restarted. The usage of endpoints
+// that were deleted is kept for them to be billed.
+type accounting struct {
+	path string // empty keeps the usage in memory only
+
+	sync.Mutex
+	usage map[string]*endpointUsage
+	dirty bool
+}
+
+func newAccounting(path string) (*accounting, error) {
+	a := &accounting{path: path, usage: map[string]*endpointUsage{}}
+	if path == "" {
+		return a, nil
+	}
+
+	// create the directory right away, rather than failing to save the
+	// usage later on
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, fmt.Errorf("creating the directory of accounting file %s failed: %v", path, err)
+	}
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return a, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading accounting file %s failed: %v", path, err)
+	}
+	if err := json.Unmarshal(b, &a.usage); err != nil {
+		return nil, fmt.Errorf("parsing accounting file %s failed: %v", path, err)
+	}
+	for id, u := range a.usage {
+		endpointConnections.Add(id, u.Connections)
+		endpointBytesSent.Add(id, u.BytesSent)
+		endpointBytesReceived.Add(id, u.BytesReceived)
+	}
+	return a, nil
+}
+
+// add counts connections of the endpoint and the bytes they relayed.
+func (a *accounting) add(endpointID, networkID, container string, connections, sent, received int64) {
+	endpointConnections.Add(endpointID, connections)
+	endpointBytesSent.Add(endpointID, sent)
+	endpointBytesReceived.Add(endpointID, received)
+
+	a.Lock()
+	defer a.Unlock()
+
+	u, ok := a.usage[endpointID]
+	if !ok {
+		u = &endpointUsage{Network: networkID}
+		a.usage[endpointID] = u
+	}
+	if container != "" {
+		u.Container = container
+	}
+	u.Connections += connections
+	u.BytesSent += sent
+	u.BytesReceived += received
+	a.dirty = true
+}
+
+// endpoint returns the usage of the endpoint.
+func (a *accounting) endpoint(endpointID string) (endpointUsage, bool) {
+	a.Lock()
+	defer a.Unlock()
+	u, ok := a.usage[endpointID]
+	if !ok {
+		return endpointUsage{}, false
+	}
+	return *u, true
+}
+
+// save writes the usage to the file if it changed since it was last
+// written.
+func (a *accounting) save() error {
+	a.Lock()
+	defer a.Unlock()
+
+	if a.path == "" || !a.dirty {
+		return nil
+	}
+	b, err := json.Marshal(a.usage)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(a.path), 0700); err != nil {
+		return err
+	}
+	// write it aside first to never leave a truncated file behind
+	tmp := a.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0600); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, a.path); err != nil {
+		return err
+	}
+	a.dirty = false
+	return nil
+}
+
+// ServeHTTP serves the usage of the endpoints as JSON, only of the
+// endpoints of a network if it is given with ?network=<id>.
+func (a *accounting) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	networkID := r.URL.Query().Get("network")
+
+	a.Lock()
+	usage := map[string]endpointUsage{}
+	for id, u := range a.usage {
+		if networkID == "" || u.Network == networkID {
+			usage[id] = *u
+		}
+	}
+	a.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(usage); err != nil {
+		logrus.Debugf("Writing the accounting response failed: %v", err)
+	}
+}
+
+// AccountingHandler serves the byte and connection counters of the
+// endpoints the transparent proxy relayed connections for.
+func (d *Driver) AccountingHandler() http.Handler {
+	return d.accounting
+}
+
+// endpointInfo returns the usage of the endpoint as the values of its
+// EndpointInfo.
+func (a *accounting) endpointInfo(endpointID string) map[string]string {
+	u, ok := a.endpoint(endpointID)
+	if !ok {
+		return map[string]string{}
+	}
+	return map[string]string{
+		"connections":    strconv.FormatInt(u.Connections, 10),
+		"bytes_sent":     strconv.FormatInt(u.BytesSent, 10),
+		"bytes_received": strconv.FormatInt(u.BytesReceived, 10),
+	}
+}
+
+// usageCounter counts what a connection relays towards its endpoint.
+type usageCounter struct {
+	accounting                       *accounting
+	endpointID, networkID, container string
+}
+
+func (c *usageCounter) add(connections, sent, received int64) {
+	c.accounting.add(c.endpointID, c.networkID, c.container, connections, sent, received)
+}
+
+// accountConnection returns the counter of a connection the transparent
+// proxy relays for the container with the address, nil if it has no
+// endpoint.
+func (n *NetworkState) accountConnection(src net.IP) *usageCounter {
+	ep := n.endpointByIP(src)
+	if ep == nil {
+		return nil
+	}
+	c := &usageCounter{accounting: n.accounting, endpointID: ep.id, networkID: n.id}
+	if container, err := n.endpointContainer(ep); err != nil {
+		logrus.Debugf("Getting the container of endpoint %s for accounting failed: %v", ep.id, err)
+	} else {
+		c.container = container.name
+	}
+	return c
+}
+
+// countingConn counts the bytes read from the container as sent and the
+// bytes written to it as received, as they are relayed.
+type countingConn struct {
+	net.Conn
+	usage *usageCounter
+}
+
+func (c *countingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		c.usage.add(0, int64(n), 0)
+	}
+	return n, err
+}
+
+func (c *countingConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	if n > 0 {
+		c.usage.add(0, 0, int64(n))
+	}
+	return n, err
+}
+
+// CloseWrite half-closes the connection if it can be.
+func (c *countingConn) CloseWrite() error {
+	closeWrite(c.Conn)
+	return nil
+}
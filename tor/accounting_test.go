@@ -0,0 +1,96 @@
+package tor
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestAccounting(t *testing.T) {
+	dir, err := ioutil.TempDir("", "onion-accounting")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "state", "accounting.json")
+
+	a, err := newAccounting(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := &NetworkState{
+		id:         "0123456789abcdef",
+		accounting: a,
+		endpoints: map[string]*torEndpoint{
+			"fedcba9876543210": {id: "fedcba9876543210", addr: &net.IPNet{IP: net.IPv4(172, 18, 0, 2)}},
+		},
+		containerInfo: func(endpointID string) (*containerInfo, error) {
+			return &containerInfo{name: "web"}, nil
+		},
+	}
+
+	n.accountConnection(net.IPv4(172, 18, 0, 2)).add(1, 517, 4096)
+	// connections of addresses without an endpoint are not counted
+	if u := n.accountConnection(net.IPv4(172, 18, 0, 9)); u != nil {
+		t.Fatalf("expected no counter without an endpoint, got %+v", u)
+	}
+
+	// the bytes are counted as they are relayed, before the connection is
+	// closed
+	client, container := net.Pipe()
+	defer container.Close()
+	conn := &countingConn{Conn: client, usage: n.accountConnection(net.IPv4(172, 18, 0, 2))}
+	go func() {
+		container.Write(make([]byte, 100))
+		io.ReadFull(container, make([]byte, 200))
+	}()
+	if _, err := io.ReadFull(conn, make([]byte, 100)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Write(make([]byte, 200)); err != nil {
+		t.Fatal(err)
+	}
+	if u, _ := a.endpoint("fedcba9876543210"); u.BytesSent != 617 || u.BytesReceived != 4296 {
+		t.Fatalf("expected the bytes of the open connection to be counted, got %+v", u)
+	}
+	conn.usage.add(1, 0, 0)
+	conn.Close()
+
+	expected := endpointUsage{Network: "0123456789abcdef", Container: "web", Connections: 2, BytesSent: 617, BytesReceived: 4296}
+	if u, _ := a.endpoint("fedcba9876543210"); u != expected {
+		t.Fatalf("expected %+v, got %+v", expected, u)
+	}
+	info := a.endpointInfo("fedcba9876543210")
+	if info["connections"] != "2" || info["bytes_sent"] != "617" || info["bytes_received"] != "4296" {
+		t.Fatalf("unexpected endpoint info %v", info)
+	}
+
+	// the usage is still there after a restart
+	if err := a.save(); err != nil {
+		t.Fatal(err)
+	}
+	a, err = newAccounting(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u, _ := a.endpoint("fedcba9876543210"); u != expected {
+		t.Fatalf("expected %+v after loading, got %+v", expected, u)
+	}
+
+	for query, count := range map[string]int{"": 1, "?network=0123456789abcdef": 1, "?network=other": 0} {
+		w := httptest.NewRecorder()
+		a.ServeHTTP(w, httptest.NewRequest("GET", "/accounting"+query, nil))
+		var usage map[string]endpointUsage
+		if err := json.Unmarshal(w.Body.Bytes(), &usage); err != nil {
+			t.Fatal(err)
+		}
+		if len(usage) != count {
+			t.Errorf("%q: expected %d endpoints, got %v", query, count, usage)
+		}
+	}
+}
@@ -0,0 +1,209 @@
+package tor
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	auditTypeDNS        = "dns"
+	auditTypeConnection = "connection"
+)
+
+// auditRecord is a line of the audit log.
+type auditRecord struct {
+	Time      time.Time `json:"time"`
+	Type      string    `json:"type"`
+	Network   string    `json:"network"`
+	Endpoint  string    `json:"endpoint,omitempty"`
+	Container string    `json:"container,omitempty"`
+	Source    string    `json:"source"`
+
+	// dns queries
+	Name  string `json:"name,omitempty"`
+	QType uint16 `json:"qtype,omitempty"`
+	Rcode string `json:"rcode,omitempty"`
+
+	// proxied connections
+	Destination   string `json:"destination,omitempty"`
+	Hostname      string `json:"hostname,omitempty"`
+	BytesSent     int64  `json:"bytes_sent,omitempty"`
+	BytesReceived int64  `json:"bytes_received,omitempty"`
+	DurationMs    int64  `json:"duration_ms,omitempty"`
+	Error         string `json:"error,omitempty"`
+}
+
+var dnsRcodeNames = map[byte]string{
+	0:                "NOERROR",
+	dnsRcodeServFail: "SERVFAIL",
+	dnsRcodeNXDomain: "NXDOMAIN",
+	dnsRcodeNotImp:   "NOTIMP",
+	5:                "REFUSED",
+}
+
+// auditLog writes the audit records as JSON lines to a file, which is
+// rotated when it would grow over maxSize, keeping maxBackups of the old
+// files as path.1, path.2 and so on.
+type auditLog struct {
+	path       string
+	maxSize    int64
+	maxBackups int
+
+	sync.Mutex
+	file *os.File
+	size int64
+}
+
+func newAuditLog(path string, maxSize int64, maxBackups int) (*auditLog, error) {
+	l := &auditLog{
+		path:       path,
+		maxSize:    maxSize,
+		maxBackups: maxBackups,
+	}
+	if err := l.open(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *auditLog) open() error {
+	f, err := os.OpenFile(l.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return fmt.Errorf("opening audit log %s failed: %v", l.path, err)
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	l.file, l.size = f, fi.Size()
+	return nil
+}
+
+// Close closes the file of the log.
+func (l *auditLog) Close() error {
+	l.Lock()
+	defer l.Unlock()
+	return l.file.Close()
+}
+
+// write appends the record to the log.
+func (l *auditLog) write(rec auditRecord) {
+	b, err := json.Marshal(rec)
+	if err != nil {
+		logrus.Warnf("Encoding audit record failed: %v", err)
+		return
+	}
+	b = append(b, '\n')
+
+	l.Lock()
+	defer l.Unlock()
+
+	if l.maxSize > 0 && l.size > 0 && l.size+int64(len(b)) > l.maxSize {
+		if err := l.rotate(); err != nil {
+			logrus.Warnf("Rotating audit log %s failed: %v", l.path, err)
+		}
+	}
+	n, err := l.file.Write(b)
+	l.size += int64(n)
+	if err != nil {
+		logrus.Warnf("Writing audit log %s failed: %v", l.path, err)
+	}
+}
+
+// rotate moves the current file out of the way and opens a new one. The
+// caller holds the lock.
+func (l *auditLog) rotate() error {
+	if err := l.file.Close(); err != nil {
+		return err
+	}
+
+	if l.maxBackups == 0 {
+		if err := os.Remove(l.path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return l.open()
+	}
+	for i := l.maxBackups - 1; i > 0; i-- {
+		if err := os.Rename(l.backup(i), l.backup(i+1)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if err := os.Rename(l.path, l.backup(1)); err != nil {
+		return err
+	}
+	return l.open()
+}
+
+func (l *auditLog) backup(i int) string {
+	return l.path + "." + strconv.Itoa(i)
+}
+
+// getAudit parses the option keeping the audit log from recording what the
+// containers on a network do. It is on by default.
+func getAudit(opts map[string]interface{}) (bool, error) {
+	v, ok := getOption(opts, auditOption)
+	if !ok || v == "" {
+		return true, nil
+	}
+	enabled, err := strconv.ParseBool(v)
+	if err != nil {
+		return false, fmt.Errorf("Invalid %s %q: %v", auditOption, v, err)
+	}
+	return enabled, nil
+}
+
+// auditRecord starts the record of something the container with the
+// address did.
+func (n *NetworkState) auditRecord(typ string, src net.IP) auditRecord {
+	rec := auditRecord{
+		Time:    time.Now().UTC(),
+		Type:    typ,
+		Network: n.id,
+		Source:  src.String(),
+	}
+	if ep := n.endpointByIP(src); ep != nil {
+		rec.Endpoint = ep.id
+		if c, err := n.endpointContainer(ep); err != nil {
+			logrus.Debugf("Getting the container of endpoint %s for the audit log failed: %v", ep.id, err)
+		} else {
+			rec.Container = c.name
+		}
+	}
+	return rec
+}
+
+// auditDNS records the dns query of the container with the address, and
+// the response code of the reply if it got one.
+func (n *NetworkState) auditDNS(src net.IP, name string, qtype uint16, reply []byte) {
+	rec := n.auditRecord(auditTypeDNS, src)
+	rec.Name, rec.QType = name, qtype
+	if len(reply) >= dnsHeaderSize {
+		rcode := reply[3] & 0x0f
+		if rec.Rcode = dnsRcodeNames[rcode]; rec.Rcode == "" {
+			rec.Rcode = strconv.Itoa(int(rcode))
+		}
+	}
+	n.audit.write(rec)
+}
+
+// auditConnection records the connection of the container with the
+// address the transparent proxy relayed, and the hostname it was for if the
+// proxy looked for it.
+func (n *NetworkState) auditConnection(src net.IP, dst, hostname string, start time.Time, sent, received int64, err error) {
+	rec := n.auditRecord(auditTypeConnection, src)
+	rec.Destination, rec.Hostname = dst, hostname
+	rec.BytesSent, rec.BytesReceived = sent, received
+	rec.DurationMs = int64(time.Since(start) / time.Millisecond)
+	if err != nil {
+		rec.Error = err.Error()
+	}
+	n.audit.write(rec)
+}
@@ -0,0 +1,113 @@
+package tor
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func readAuditLog(t *testing.T, path string) []auditRecord {
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	var records []auditRecord
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var rec auditRecord
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			t.Fatalf("decoding %q failed: %v", scanner.Text(), err)
+		}
+		records = append(records, rec)
+	}
+	return records
+}
+
+func TestAuditLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "onion-audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "audit.log")
+
+	l, err := newAuditLog(path, 1<<20, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	n := &NetworkState{
+		id:    "0123456789abcdef",
+		audit: l,
+		endpoints: map[string]*torEndpoint{
+			"fedcba9876543210": {id: "fedcba9876543210", addr: &net.IPNet{IP: net.IPv4(172, 18, 0, 2)}},
+		},
+		containerInfo: func(endpointID string) (*containerInfo, error) {
+			return &containerInfo{name: "web"}, nil
+		},
+	}
+
+	reply := dnsErrorReply(dnsQuery(1, "example.com"), dnsHeaderSize+13+4, dnsRcodeNXDomain)
+	n.auditDNS(net.IPv4(172, 18, 0, 2), "example.com", dnsTypeA, reply)
+	n.auditConnection(net.IPv4(172, 18, 0, 2), "93.184.216.34:443", "example.com", time.Now(), 517, 4096, nil)
+	n.auditConnection(net.IPv4(172, 18, 0, 9), "93.184.216.34:80", "", time.Now(), 0, 0, os.ErrDeadlineExceeded)
+
+	records := readAuditLog(t, path)
+	if len(records) != 3 {
+		t.Fatalf("expected 3 records, got %d", len(records))
+	}
+	dns, conn, unknown := records[0], records[1], records[2]
+	if dns.Type != auditTypeDNS || dns.Name != "example.com" || dns.QType != dnsTypeA || dns.Rcode != "NXDOMAIN" ||
+		dns.Endpoint != "fedcba9876543210" || dns.Container != "web" || dns.Network != "0123456789abcdef" {
+		t.Fatalf("unexpected dns record %+v", dns)
+	}
+	if conn.Type != auditTypeConnection || conn.Destination != "93.184.216.34:443" || conn.Hostname != "example.com" ||
+		conn.BytesSent != 517 || conn.BytesReceived != 4096 || conn.Container != "web" {
+		t.Fatalf("unexpected connection record %+v", conn)
+	}
+	if unknown.Endpoint != "" || unknown.Source != "172.18.0.9" || unknown.Error == "" {
+		t.Fatalf("unexpected record for an unknown address %+v", unknown)
+	}
+}
+
+func TestAuditLogRotation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "onion-audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "audit.log")
+
+	// room for a single record a file
+	l, err := newAuditLog(path, 100, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	for _, name := range []string{"a.example", "b.example", "c.example", "d.example"} {
+		l.write(auditRecord{Type: auditTypeDNS, Name: name})
+	}
+
+	for file, name := range map[string]string{
+		path:        "d.example",
+		path + ".1": "c.example",
+		path + ".2": "b.example",
+	} {
+		records := readAuditLog(t, file)
+		if len(records) != 1 || records[0].Name != name {
+			t.Fatalf("expected %s to hold the record for %s, got %+v", file, name, records)
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Fatalf("expected only 2 backups to be kept, got %v", err)
+	}
+}
@@ -0,0 +1,129 @@
+package tor
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// bypassRule is a destination that is exempt from being redirected into tor.
+// An empty port matches every port and an empty proto matches every protocol.
+type bypassRule struct {
+	dest  *net.IPNet
+	port  string
+	proto string
+}
+
+func (b bypassRule) String() string {
+	s := b.dest.String()
+	if b.port != "" {
+		s += ":" + b.port
+	}
+	if b.proto != "" {
+		s += "/" + b.proto
+	}
+	return s
+}
+
+// getBypassRules parses the bypass option. It is a comma separated list of
+// entries in the form CIDR[:port[/proto]], for example
+// "10.0.0.0/8,192.168.1.10:5432/tcp". A bare IP address is treated as a /32.
+func getBypassRules(opts map[string]interface{}) ([]bypassRule, error) {
+	v, ok := getOption(opts, bypassOption)
+	if !ok || strings.TrimSpace(v) == "" {
+		return nil, nil
+	}
+
+	var rules []bypassRule
+	for _, entry := range strings.Split(v, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		b, err := parseBypassRule(entry)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid %s entry %q: %v", bypassOption, entry, err)
+		}
+		rules = append(rules, b)
+	}
+	return rules, nil
+}
+
+func parseBypassRule(entry string) (bypassRule, error) {
+	var b bypassRule
+
+	// the port is split off at the last colon, which an ipv6 address
+	// would be torn apart at
+	if strings.Count(entry, ":") > 1 || strings.HasPrefix(entry, "[") {
+		return b, fmt.Errorf("ipv6 destinations are not supported, the networks are ipv4 only")
+	}
+
+	dest, port := entry, ""
+	if i := strings.LastIndex(entry, ":"); i != -1 {
+		dest, port = entry[:i], entry[i+1:]
+		if port == "" {
+			return b, fmt.Errorf("missing port")
+		}
+	}
+
+	if i := strings.Index(port, "/"); i != -1 {
+		port, b.proto = port[:i], strings.ToLower(port[i+1:])
+		if b.proto != "tcp" && b.proto != "udp" {
+			return b, fmt.Errorf("unsupported protocol %q", b.proto)
+		}
+	}
+	if port != "" {
+		p, err := strconv.Atoi(port)
+		if err != nil || p < 1 || p > 65535 {
+			return b, fmt.Errorf("invalid port %q", port)
+		}
+		b.port = port
+		if b.proto == "" {
+			b.proto = "tcp"
+		}
+	}
+
+	if !strings.Contains(dest, "/") {
+		dest += "/32"
+	}
+	ip, ipnet, err := net.ParseCIDR(dest)
+	if err != nil {
+		return b, err
+	}
+	if ip.To4() == nil {
+		return b, ErrUnsupportedAddressType(dest)
+	}
+	b.dest = ipnet
+
+	return b, nil
+}
+
+// bypassTor exempts the configured destinations from the redirect into tor.
+// The rules have to come ahead of the redirect rules.
+func (fc *firewallConfig) bypassTor() []firewallRule {
+	var rules []firewallRule
+	for _, b := range fc.bypass {
+		rules = append(rules,
+			// skip the redirect to tor
+			firewallRule{table: "nat", chain: "PREROUTING", in: fc.bridgeName,
+				dst: b.dest.String(), proto: b.proto, dport: b.port, target: "RETURN"},
+			// let it through the udp blocking rules in both directions
+			firewallRule{table: "filter", chain: "FORWARD", in: fc.bridgeName,
+				dst: b.dest.String(), proto: b.proto, dport: b.port, target: "ACCEPT"},
+			firewallRule{table: "filter", chain: "FORWARD", out: fc.bridgeName,
+				src: b.dest.String(), proto: b.proto, sport: b.port, target: "ACCEPT"},
+		)
+	}
+	return rules
+}
+
+// logBypass makes it explicit in the logs which destinations do not go
+// through tor.
+func (fc *firewallConfig) logBypass() {
+	for _, b := range fc.bypass {
+		logrus.Warnf("Traffic from bridge %s to %s bypasses tor", fc.bridgeName, b)
+	}
+}
@@ -0,0 +1,60 @@
+package tor
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/docker/libnetwork/netlabel"
+)
+
+func TestGetBypassRules(t *testing.T) {
+	testCases := []struct {
+		value    string
+		expected []string
+		err      bool
+	}{
+		{value: "", expected: nil},
+		{value: "10.0.0.0/8", expected: []string{"10.0.0.0/8"}},
+		{value: "192.168.1.10", expected: []string{"192.168.1.10/32"}},
+		{value: "192.168.1.10:5432", expected: []string{"192.168.1.10/32:5432/tcp"}},
+		{value: "10.0.0.0/8, 172.16.0.1:53/udp", expected: []string{"10.0.0.0/8", "172.16.0.1/32:53/udp"}},
+		{value: "10.0.0.0/8:", err: true},
+		{value: "10.0.0.0/8:99999", err: true},
+		{value: "10.0.0.0/8:53/icmp", err: true},
+		{value: "not-an-ip", err: true},
+		{value: "fd00::1", err: true},
+		{value: "fd00::/64", err: true},
+		{value: "[fd00::1]:5432", err: true},
+	}
+
+	for _, tc := range testCases {
+		opts := map[string]interface{}{
+			netlabel.GenericData: map[string]interface{}{bypassOption: tc.value},
+		}
+		rules, err := getBypassRules(opts)
+		if tc.err {
+			if err == nil {
+				t.Errorf("expected error for %q, got rules %v", tc.value, rules)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("unexpected error for %q: %v", tc.value, err)
+			continue
+		}
+		if len(rules) != len(tc.expected) {
+			t.Errorf("expected %d rules for %q, got %d", len(tc.expected), tc.value, len(rules))
+			continue
+		}
+		for i, r := range rules {
+			if r.String() != tc.expected[i] {
+				t.Errorf("expected rule %d for %q to be %s, got %s", i, tc.value, tc.expected[i], r)
+			}
+		}
+	}
+	// ipv6 addresses get an error saying so rather than a confusing one
+	// about their last group being a port
+	if _, err := parseBypassRule("fd00::1"); err == nil || !strings.Contains(err.Error(), "ipv6") {
+		t.Errorf("expected an ipv6 error for fd00::1, got %v", err)
+	}
+}
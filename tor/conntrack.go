@@ -0,0 +1,43 @@
+package tor
+
+import (
+	"net"
+
+	"github.com/sirupsen/logrus"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// directFlowFilter matches the conntrack flows from the subnet that were not
+// redirected into tor. Those were set up before the rules were in place, or
+// while they were missing, and would otherwise keep going around tor. Once
+// deleted, their next packet is a new flow that is not a syn, which the
+// policy resets.
+//
+// Flows that were redirected are left alone: deleting them would get them
+// reset the same way.
+type directFlowFilter struct {
+	subnet *net.IPNet
+}
+
+func (f directFlowFilter) MatchConntrackFlow(flow *netlink.ConntrackFlow) bool {
+	if !f.subnet.Contains(flow.Forward.SrcIP) {
+		return false
+	}
+	// a redirected flow has its replies come from somewhere other than
+	// where the packets were sent to
+	return flow.Reverse.SrcIP.Equal(flow.Forward.DstIP)
+}
+
+// flushConntrack deletes the conntrack entries of the flows from the subnet
+// that go around tor, so they are subject to the current rules.
+func flushConntrack(subnet *net.IPNet) error {
+	n, err := netlink.ConntrackDeleteFilter(netlink.ConntrackTable, unix.AF_INET, directFlowFilter{subnet: subnet})
+	if err != nil {
+		return err
+	}
+	if n > 0 {
+		logrus.Infof("Flushed %d conntrack entries for %s", n, subnet)
+	}
+	return nil
+}
@@ -0,0 +1,34 @@
+package tor
+
+import (
+	"net"
+	"testing"
+
+	"github.com/vishvananda/netlink"
+)
+
+func TestDirectFlowFilter(t *testing.T) {
+	_, subnet, _ := net.ParseCIDR("172.18.0.0/16")
+	f := directFlowFilter{subnet: subnet}
+
+	direct := &netlink.ConntrackFlow{}
+	direct.Forward.SrcIP, direct.Forward.DstIP = net.ParseIP("172.18.0.2"), net.ParseIP("93.184.216.34")
+	direct.Reverse.SrcIP, direct.Reverse.DstIP = net.ParseIP("93.184.216.34"), net.ParseIP("192.168.1.2")
+	if !f.MatchConntrackFlow(direct) {
+		t.Error("expected a flow going around tor to match")
+	}
+
+	redirected := &netlink.ConntrackFlow{}
+	redirected.Forward.SrcIP, redirected.Forward.DstIP = net.ParseIP("172.18.0.2"), net.ParseIP("93.184.216.34")
+	redirected.Reverse.SrcIP, redirected.Reverse.DstIP = net.ParseIP("172.18.0.1"), net.ParseIP("172.18.0.2")
+	if f.MatchConntrackFlow(redirected) {
+		t.Error("expected a flow redirected into tor not to match")
+	}
+
+	other := &netlink.ConntrackFlow{}
+	other.Forward.SrcIP, other.Forward.DstIP = net.ParseIP("10.0.0.2"), net.ParseIP("93.184.216.34")
+	other.Reverse.SrcIP, other.Reverse.DstIP = net.ParseIP("93.184.216.34"), net.ParseIP("10.0.0.2")
+	if f.MatchConntrackFlow(other) {
+		t.Error("expected a flow from another subnet not to match")
+	}
+}
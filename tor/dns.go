@@ -0,0 +1,301 @@
+package tor
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	dnsHeaderSize     = 12
+	dnsMaxUDPSize     = 4096
+	dnsTimeout        = 5 * time.Second
+	dnsTCPIdleTimeout = 10 * time.Second
+	dnsRcodeNXDomain  = 3
+)
+
+// dnsQuestion parses the first question of a DNS message, returning the
+// name, the query type and where the question ends.
+func dnsQuestion(msg []byte) (string, uint16, int, error) {
+	if len(msg) < dnsHeaderSize {
+		return "", 0, 0, fmt.Errorf("dns message too short")
+	}
+	if binary.BigEndian.Uint16(msg[4:6]) == 0 {
+		return "", 0, 0, fmt.Errorf("dns message has no question")
+	}
+
+	var labels []string
+	off := dnsHeaderSize
+	for {
+		if off >= len(msg) {
+			return "", 0, 0, fmt.Errorf("dns question truncated")
+		}
+		l := int(msg[off])
+		off++
+		if l == 0 {
+			break
+		}
+		// questions are never compressed
+		if l&0xc0 != 0 || off+l > len(msg) {
+			return "", 0, 0, fmt.Errorf("invalid label in dns question")
+		}
+		labels = append(labels, string(msg[off:off+l]))
+		off += l
+	}
+	if off+4 > len(msg) {
+		return "", 0, 0, fmt.Errorf("dns question truncated")
+	}
+
+	qtype := binary.BigEndian.Uint16(msg[off : off+2])
+	return strings.ToLower(strings.Join(labels, ".")), qtype, off + 4, nil
+}
+
+// dnsQuery builds an A query for the name.
+func dnsQuery(id uint16, name string) []byte {
+	q := make([]byte, dnsHeaderSize)
+	binary.BigEndian.PutUint16(q[0:2], id)
+	q[2] = 0x01 // recursion desired
+	binary.BigEndian.PutUint16(q[4:6], 1)
+	for _, l := range strings.Split(name, ".") {
+		q = append(q, byte(len(l)))
+		q = append(q, l...)
+	}
+	return append(q, 0, 0, 1, 0, 1)
+}
+
+// dnsErrorReply builds a reply to the query holding only its question and
+// the response code.
+func dnsErrorReply(query []byte, end int, rcode byte) []byte {
+	r := append([]byte{}, query[:end]...)
+	r[2] = 0x80 | query[2]&0x79 // response, keep the opcode and recursion desired
+	r[3] = 0x80 | rcode         // recursion available
+	binary.BigEndian.PutUint16(r[4:6], 1)
+	binary.BigEndian.PutUint16(r[6:8], 0)
+	binary.BigEndian.PutUint16(r[8:10], 0)
+	binary.BigEndian.PutUint16(r[10:12], 0)
+	return r
+}
+
+// dnsServer answers the DNS queries of the containers on a network, over
+// udp and tcp. Queries for the names it allows are answered by the resolver
+// or, without one, forwarded to the upstream resolver, tor's DNSPort.
+// Everything else gets an NXDOMAIN. A nil allow allows every name. If set,
+// audit is called with every query and its reply.
+type dnsServer struct {
+	upstream string
+	resolver *socksResolver
+	i2p      *i2pAddrMap
+	allow    func(name string) bool
+	audit    func(src net.IP, name string, qtype uint16, reply []byte)
+	udp      *net.UDPConn
+	tcp      *net.TCPListener
+}
+
+// listen starts answering the queries sent to the address.
+func (s *dnsServer) listen(listen string) error {
+	addr, err := net.ResolveUDPAddr("udp", listen)
+	if err != nil {
+		return err
+	}
+	s.udp, err = net.ListenUDP("udp", addr)
+	if err != nil {
+		return fmt.Errorf("listening for dns queries on %s failed: %v", listen, err)
+	}
+	// listen on the same port over tcp, which matters when the port was
+	// picked by the kernel
+	s.tcp, err = net.ListenTCP("tcp", &net.TCPAddr{IP: addr.IP, Port: s.udp.LocalAddr().(*net.UDPAddr).Port})
+	if err != nil {
+		s.udp.Close()
+		return fmt.Errorf("listening for dns queries over tcp on %s failed: %v", listen, err)
+	}
+
+	go s.serveUDP()
+	go s.serveTCP()
+	return nil
+}
+
+// Close stops the server.
+func (s *dnsServer) Close() error {
+	s.tcp.Close()
+	return s.udp.Close()
+}
+
+func (s *dnsServer) serveUDP() {
+	for {
+		b := make([]byte, dnsMaxUDPSize)
+		n, from, err := s.udp.ReadFromUDP(b)
+		if err != nil {
+			if strings.Contains(err.Error(), "use of closed network connection") {
+				return
+			}
+			logrus.Warnf("Reading dns query failed: %v", err)
+			continue
+		}
+		go func() {
+			if reply := s.handle(b[:n], from.IP); reply != nil {
+				if _, err := s.udp.WriteToUDP(reply, from); err != nil {
+					logrus.Debugf("Writing dns reply to %s failed: %v", from, err)
+				}
+			}
+		}()
+	}
+}
+
+func (s *dnsServer) serveTCP() {
+	for {
+		conn, err := s.tcp.Accept()
+		if err != nil {
+			if strings.Contains(err.Error(), "use of closed network connection") {
+				return
+			}
+			logrus.Warnf("Accepting dns connection failed: %v", err)
+			continue
+		}
+		go s.handleTCP(conn)
+	}
+}
+
+// handleTCP answers the queries sent over the connection, each message is
+// prefixed with its length.
+func (s *dnsServer) handleTCP(conn net.Conn) {
+	defer conn.Close()
+
+	for {
+		conn.SetDeadline(time.Now().Add(dnsTCPIdleTimeout))
+
+		var l [2]byte
+		if _, err := io.ReadFull(conn, l[:]); err != nil {
+			return
+		}
+		query := make([]byte, binary.BigEndian.Uint16(l[:]))
+		if _, err := io.ReadFull(conn, query); err != nil {
+			return
+		}
+
+		reply := s.handle(query, conn.RemoteAddr().(*net.TCPAddr).IP)
+		if reply == nil {
+			return
+		}
+		binary.BigEndian.PutUint16(l[:], uint16(len(reply)))
+		if _, err := conn.Write(append(l[:], reply...)); err != nil {
+			logrus.Debugf("Writing dns reply to %s failed: %v", conn.RemoteAddr(), err)
+			return
+		}
+	}
+}
+
+// handle returns the reply to the query from the address, or nil if there
+// should be none.
+func (s *dnsServer) handle(query []byte, from net.IP) []byte {
+	name, qtype, end, err := dnsQuestion(query)
+	if err != nil {
+		logrus.Debugf("Dropping dns query: %v", err)
+		return nil
+	}
+
+	reply := s.reply(query, name, qtype, end)
+	if s.audit != nil {
+		s.audit(from, name, qtype, reply)
+	}
+	return reply
+}
+
+// reply returns the reply to the query for the name, or nil if there
+// should be none.
+func (s *dnsServer) reply(query []byte, name string, qtype uint16, end int) []byte {
+	if s.allow != nil && !s.allow(name) {
+		logrus.Debugf("Refusing to resolve %s", name)
+		return dnsErrorReply(query, end, dnsRcodeNXDomain)
+	}
+
+	if s.i2p != nil {
+		if reply := s.i2p.answer(query, name, qtype, end); reply != nil {
+			return reply
+		}
+	}
+
+	if s.resolver != nil {
+		return s.resolver.answer(query, name, qtype, end)
+	}
+
+	reply, err := s.forward(query)
+	if err != nil {
+		logrus.Warnf("Forwarding dns query for %s failed: %v", name, err)
+		return nil
+	}
+	return reply
+}
+
+// forward sends the query to the upstream resolver and returns its reply.
+func (s *dnsServer) forward(query []byte) ([]byte, error) {
+	conn, err := net.DialTimeout("udp", s.upstream, dnsTimeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(dnsTimeout))
+	if _, err := conn.Write(query); err != nil {
+		return nil, err
+	}
+
+	b := make([]byte, dnsMaxUDPSize)
+	for {
+		n, err := conn.Read(b)
+		if err != nil {
+			return nil, err
+		}
+		// ignore anything that is not the reply to our query
+		if n >= dnsHeaderSize && b[0] == query[0] && b[1] == query[1] {
+			return b[:n], nil
+		}
+	}
+}
+
+// startDNS starts the dns server of the network. Onion-only and i2p-only
+// networks only get .onion and .i2p names resolved, and the names have to
+// pass the dns policy of the network.
+func (n *NetworkState) startDNS() error {
+	var allow func(string) bool
+	if n.onionOnly || n.i2p == i2pOnly || n.dnsPolicy != nil {
+		allow = func(name string) bool {
+			if n.onionOnly && !isOnionName(name) {
+				return false
+			}
+			if n.i2p == i2pOnly && !isI2PName(name) {
+				return false
+			}
+			return n.dnsPolicy == nil || n.dnsPolicy.permit(name)
+		}
+	}
+
+	s := &dnsServer{
+		upstream: torDNSUpstream,
+		i2p:      n.i2pAddrs,
+		allow:    allow,
+	}
+	if n.resolverUpstream != nil {
+		s.resolver = newSOCKSResolver(n.resolverUpstream, n.id, n.virtualNet)
+	}
+	if n.audit != nil {
+		s.audit = n.auditDNS
+	}
+	if err := s.listen(n.host.listenAddr("dns", net.JoinHostPort(n.Gateway, dnsProxyPort))); err != nil {
+		return err
+	}
+	n.dns = s
+	return nil
+}
+
+// stopDNS stops the dns server of the network, if it has one.
+func (n *NetworkState) stopDNS() error {
+	if n.dns == nil {
+		return nil
+	}
+	return n.dns.Close()
+}
@@ -0,0 +1,132 @@
+package tor
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// fakeUpstream answers every query with the query itself, marked as a
+// response.
+func fakeUpstream(t *testing.T) *net.UDPConn {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		b := make([]byte, dnsMaxUDPSize)
+		for {
+			n, from, err := conn.ReadFromUDP(b)
+			if err != nil {
+				return
+			}
+			reply := append([]byte{}, b[:n]...)
+			reply[2] |= 0x80
+			conn.WriteToUDP(reply, from)
+		}
+	}()
+	return conn
+}
+
+func exchangeUDP(t *testing.T, addr string, query []byte) []byte {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	if _, err := conn.Write(query); err != nil {
+		t.Fatal(err)
+	}
+	b := make([]byte, dnsMaxUDPSize)
+	n, err := conn.Read(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b[:n]
+}
+
+func TestDNSQuestion(t *testing.T) {
+	name, qtype, end, err := dnsQuestion(dnsQuery(1, "Example.ONION"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name != "example.onion" || qtype != 1 || end != dnsHeaderSize+15+4 {
+		t.Fatalf("unexpected question %s type %d ending at %d", name, qtype, end)
+	}
+
+	if _, _, _, err := dnsQuestion([]byte{0, 1, 2}); err == nil {
+		t.Fatal("expected error parsing a short message")
+	}
+}
+
+func exchangeTCP(t *testing.T, addr string, query []byte) []byte {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+
+	l := make([]byte, 2)
+	binary.BigEndian.PutUint16(l, uint16(len(query)))
+	if _, err := conn.Write(append(l, query...)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(conn, l); err != nil {
+		t.Fatal(err)
+	}
+	reply := make([]byte, binary.BigEndian.Uint16(l))
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		t.Fatal(err)
+	}
+	return reply
+}
+
+func TestDNSServerOnionOnly(t *testing.T) {
+	upstream := fakeUpstream(t)
+	defer upstream.Close()
+
+	s := &dnsServer{upstream: upstream.LocalAddr().String(), allow: isOnionName}
+	if err := s.listen("127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	addr := s.udp.LocalAddr().String()
+
+	for transport, exchange := range map[string]func(*testing.T, string, []byte) []byte{
+		"udp": exchangeUDP,
+		"tcp": exchangeTCP,
+	} {
+		// .onion names are forwarded
+		reply := exchange(t, addr, dnsQuery(42, "duckduckgogg42xjoc72x3sjasowoarfbgcmvfimaftt6twagswzczad.onion"))
+		if binary.BigEndian.Uint16(reply[0:2]) != 42 || reply[3]&0x0f != 0 {
+			t.Fatalf("%s: expected the upstream reply, got %v", transport, reply[:dnsHeaderSize])
+		}
+
+		// everything else gets an NXDOMAIN
+		reply = exchange(t, addr, dnsQuery(43, "example.com"))
+		if binary.BigEndian.Uint16(reply[0:2]) != 43 || reply[2]&0x80 == 0 || reply[3]&0x0f != dnsRcodeNXDomain {
+			t.Fatalf("%s: expected an NXDOMAIN reply, got %v", transport, reply[:dnsHeaderSize])
+		}
+	}
+}
+
+func TestDNSServerForwardsOverTCP(t *testing.T) {
+	upstream := fakeUpstream(t)
+	defer upstream.Close()
+
+	s := &dnsServer{upstream: upstream.LocalAddr().String()}
+	if err := s.listen("127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	// a udp upstream answers queries that came in over tcp
+	reply := exchangeTCP(t, s.tcp.Addr().String(), dnsQuery(7, "example.com"))
+	if binary.BigEndian.Uint16(reply[0:2]) != 7 || reply[2]&0x80 == 0 || reply[3]&0x0f != 0 {
+		t.Fatalf("expected the upstream reply, got %v", reply[:dnsHeaderSize])
+	}
+}
@@ -0,0 +1,233 @@
+package tor
+
+import (
+	"bufio"
+	"expvar"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// domainListFilePrefix marks an entry of a domain list naming a file of
+	// more entries.
+	domainListFilePrefix = "file:"
+	// domainListReloadInterval is how often the files of the domain lists are
+	// checked for changes.
+	domainListReloadInterval = 5 * time.Second
+	// notAllowedRule is the rule counting the names refused for not being
+	// on the allow list.
+	notAllowedRule = "not-allowed"
+)
+
+// domainSet holds exact domains and suffixes, a suffix being stored with
+// its leading dot.
+type domainSet struct {
+	exact    map[string]bool
+	suffixes []string
+}
+
+func (s *domainSet) add(entry string) error {
+	entry = strings.TrimSuffix(strings.ToLower(strings.TrimSpace(entry)), ".")
+	entry = strings.TrimPrefix(entry, "*")
+	if entry == "" || entry == "." || strings.ContainsAny(entry, " \t/:") {
+		return fmt.Errorf("invalid domain %q", entry)
+	}
+	if strings.HasPrefix(entry, ".") {
+		s.suffixes = append(s.suffixes, entry)
+		return nil
+	}
+	s.exact[entry] = true
+	return nil
+}
+
+// match returns the entry matching the name, or an empty string. A suffix
+// matches the domain itself and all of its subdomains.
+func (s *domainSet) match(name string) string {
+	if s.exact[name] {
+		return name
+	}
+	for _, suffix := range s.suffixes {
+		if strings.HasSuffix(name, suffix) || name == suffix[1:] {
+			return suffix
+		}
+	}
+	return ""
+}
+
+// domainFile is a file of domain list entries, one or more a line. Lines
+// in the hosts file format, as blocklists are often published, list the
+// domains after the address. The file is read again when it changes.
+type domainFile struct {
+	path string
+
+	sync.Mutex
+	set     *domainSet
+	modTime time.Time
+	size    int64
+	checked time.Time
+}
+
+func newDomainFile(path string) (*domainFile, error) {
+	f := &domainFile{path: path}
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := f.load(fi); err != nil {
+		return nil, err
+	}
+	f.checked = time.Now()
+	return f, nil
+}
+
+func (f *domainFile) load(fi os.FileInfo) error {
+	file, err := os.Open(f.path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	set := &domainSet{exact: map[string]bool{}}
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(strings.SplitN(scanner.Text(), "#", 2)[0])
+		if len(fields) > 1 && net.ParseIP(fields[0]) != nil {
+			fields = fields[1:]
+		}
+		for _, entry := range fields {
+			if err := set.add(entry); err != nil {
+				return fmt.Errorf("%s:%d: %v", f.path, line, err)
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	f.set, f.modTime, f.size = set, fi.ModTime(), fi.Size()
+	return nil
+}
+
+// match returns whether an entry of the file matches the name, reading
+// the file again first if it changed. A file that cannot be read keeps the
+// entries it had.
+func (f *domainFile) match(name string) bool {
+	f.Lock()
+	defer f.Unlock()
+
+	if time.Since(f.checked) >= domainListReloadInterval {
+		f.checked = time.Now()
+		fi, err := os.Stat(f.path)
+		if err != nil {
+			logrus.Warnf("Checking domain list %s for changes failed: %v", f.path, err)
+		} else if !fi.ModTime().Equal(f.modTime) || fi.Size() != f.size {
+			if err := f.load(fi); err != nil {
+				logrus.Warnf("Reloading domain list %s failed, keeping the previous entries: %v", f.path, err)
+			} else {
+				logrus.Infof("Reloaded domain list %s", f.path)
+			}
+		}
+	}
+
+	return f.set.match(name) != ""
+}
+
+// domainList is a list of domains given in a network option.
+type domainList struct {
+	set   *domainSet
+	files []*domainFile
+}
+
+// getDomainList parses the comma separated domains of the option, nil if
+// it is not set. An entry is a domain, a .domain suffix or file:<path>.
+func getDomainList(opts map[string]interface{}, option string) (*domainList, error) {
+	v, ok := getOption(opts, option)
+	if !ok || v == "" {
+		return nil, nil
+	}
+
+	l := &domainList{set: &domainSet{exact: map[string]bool{}}}
+	for _, entry := range strings.Split(v, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if strings.HasPrefix(entry, domainListFilePrefix) {
+			f, err := newDomainFile(strings.TrimPrefix(entry, domainListFilePrefix))
+			if err != nil {
+				return nil, fmt.Errorf("Invalid %s: %v", option, err)
+			}
+			l.files = append(l.files, f)
+			continue
+		}
+		if err := l.set.add(entry); err != nil {
+			return nil, fmt.Errorf("Invalid %s: %v", option, err)
+		}
+	}
+	return l, nil
+}
+
+// match returns the rule matching the name, or an empty string.
+func (l *domainList) match(name string) string {
+	if rule := l.set.match(name); rule != "" {
+		return rule
+	}
+	for _, f := range l.files {
+		if f.match(name) {
+			return domainListFilePrefix + f.path
+		}
+	}
+	return ""
+}
+
+// domainPolicy decides which names the containers on a network may use,
+// counting the rule that decided each name in hits. A name on the deny
+// list is refused, and with an allow list so is every name not on it.
+type domainPolicy struct {
+	networkID string
+	allow     *domainList
+	deny      *domainList
+	hits      *expvar.Map
+}
+
+// getDomainPolicy parses the allow and deny options of a network, nil if
+// it has neither.
+func getDomainPolicy(id string, opts map[string]interface{}, allowOption, denyOption string, hits *expvar.Map) (*domainPolicy, error) {
+	allow, err := getDomainList(opts, allowOption)
+	if err != nil {
+		return nil, err
+	}
+	deny, err := getDomainList(opts, denyOption)
+	if err != nil {
+		return nil, err
+	}
+	if allow == nil && deny == nil {
+		return nil, nil
+	}
+	return &domainPolicy{networkID: id, allow: allow, deny: deny, hits: hits}, nil
+}
+
+// permit returns whether the name may be used.
+func (p *domainPolicy) permit(name string) bool {
+	if p.deny != nil {
+		if rule := p.deny.match(name); rule != "" {
+			p.hits.Add(p.networkID+"/deny/"+rule, 1)
+			return false
+		}
+	}
+	if p.allow != nil {
+		rule := p.allow.match(name)
+		if rule == "" {
+			p.hits.Add(p.networkID+"/deny/"+notAllowedRule, 1)
+			return false
+		}
+		p.hits.Add(p.networkID+"/allow/"+rule, 1)
+	}
+	return true
+}
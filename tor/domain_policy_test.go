@@ -0,0 +1,99 @@
+package tor
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/docker/libnetwork/netlabel"
+)
+
+func TestDNSPolicy(t *testing.T) {
+	dir, err := ioutil.TempDir("", "onion-dns-policy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	blocklist := filepath.Join(dir, "blocklist")
+	if err := ioutil.WriteFile(blocklist, []byte("# trackers\n0.0.0.0 tracker.example ads.example\n.doubleclick.net\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := getDomainPolicy("net1", map[string]interface{}{netlabel.GenericData: map[string]string{
+		dnsAllowOption: ".example,,torproject.org,",
+		dnsDenyOption:  "bad.example,file:" + blocklist,
+	}}, dnsAllowOption, dnsDenyOption, dnsPolicyHits)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := map[string]bool{
+		"example":               true,
+		"www.example":           true,
+		"torproject.org":        true,
+		"www.torproject.org":    false, // not on the allow list
+		"bad.example":           false,
+		"tracker.example":       false,
+		"ads.example":           false,
+		"stats.doubleclick.net": false,
+		"duckduckgo.com":        false,
+		"notexample":            false,
+	}
+	for name, expected := range tests {
+		if allowed := p.permit(name); allowed != expected {
+			t.Errorf("%s: expected allowed to be %v, got %v", name, expected, allowed)
+		}
+	}
+
+	for key, expected := range map[string]string{
+		"net1/allow/.example":         "2",
+		"net1/deny/bad.example":       "1",
+		"net1/deny/file:" + blocklist: "3",
+		"net1/deny/" + notAllowedRule: "3",
+	} {
+		if v := dnsPolicyHits.Get(key); v == nil || v.String() != expected {
+			t.Errorf("expected counter %s to be %s, got %v", key, expected, v)
+		}
+	}
+
+	// the file is read again when it changed
+	if err := ioutil.WriteFile(blocklist, []byte("www.example\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	p.deny.files[0].checked = time.Time{}
+	if p.permit("www.example") || !p.permit("ads.example") {
+		t.Fatal("expected the changed blocklist to be used")
+	}
+
+	for _, v := range []string{"file:" + filepath.Join(dir, "missing"), "bad domain", "."} {
+		if _, err := getDomainPolicy("net1", map[string]interface{}{netlabel.GenericData: map[string]string{dnsDenyOption: v}}, dnsAllowOption, dnsDenyOption, dnsPolicyHits); err == nil {
+			t.Errorf("expected error for %q", v)
+		}
+	}
+}
+
+func TestDNSServerPolicy(t *testing.T) {
+	upstream := fakeUpstream(t)
+	defer upstream.Close()
+
+	p := &domainPolicy{networkID: "net2", hits: dnsPolicyHits, deny: &domainList{
+		set: &domainSet{exact: map[string]bool{}, suffixes: []string{".tracker.example"}},
+	}}
+	s := &dnsServer{upstream: upstream.LocalAddr().String(), allow: p.permit}
+	if err := s.listen("127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	reply := exchangeUDP(t, s.udp.LocalAddr().String(), dnsQuery(9, "cdn.tracker.example"))
+	if binary.BigEndian.Uint16(reply[0:2]) != 9 || reply[3]&0x0f != dnsRcodeNXDomain {
+		t.Fatalf("expected an NXDOMAIN reply, got %v", reply[:dnsHeaderSize])
+	}
+	reply = exchangeUDP(t, s.udp.LocalAddr().String(), dnsQuery(10, "example.com"))
+	if reply[3]&0x0f != 0 {
+		t.Fatalf("expected the upstream reply, got %v", reply[:dnsHeaderSize])
+	}
+}
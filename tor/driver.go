@@ -2,8 +2,11 @@ package tor
 
 import (
 	"fmt"
+	"io"
 	"net"
+	"net/url"
 	"sync"
+	"time"
 
 	"github.com/docker/docker/client"
 	"github.com/docker/go-plugins-helpers/network"
@@ -23,16 +26,101 @@ const (
 
 	mtuOption        = "net.jessfraz.tor.bridge.mtu"
 	bridgeNameOption = "net.jessfraz.tor.bridge.name"
+	bypassOption     = "net.jessfraz.tor.bypass"
+	hostAllowOption  = "net.jessfraz.tor.host.allow"
+
+	sandboxFirewallOption       = "net.jessfraz.tor.sandbox_firewall"
+	onionOnlyOption             = "net.jessfraz.tor.onion_only"
+	virtualAddrNetworkOption    = "net.jessfraz.tor.virtual_addr_network"
+	egressAllowOption           = "net.jessfraz.tor.egress.allow"
+	egressDenyOption            = "net.jessfraz.tor.egress.deny"
+	rateLimitOption             = "net.jessfraz.tor.rate_limit"
+	rateLimitBurstOption        = "net.jessfraz.tor.rate_limit.burst"
+	iccOption                   = "net.jessfraz.tor.icc"
+	isolationOption             = "net.jessfraz.tor.isolation"
+	isolationGroupOption        = "net.jessfraz.tor.isolation.group"
+	dnsAllowOption              = "net.jessfraz.tor.dns.allow"
+	dnsDenyOption               = "net.jessfraz.tor.dns.deny"
+	auditOption                 = "net.jessfraz.tor.audit"
+	hostsAllowOption            = "net.jessfraz.tor.hosts.allow"
+	hostsDenyOption             = "net.jessfraz.tor.hosts.deny"
+	upstreamOption              = "net.jessfraz.tor.upstream"
+	i2pOption                   = "net.jessfraz.tor.i2p"
+	i2pVirtualAddrNetworkOption = "net.jessfraz.tor.i2p.virtual_addr_network"
+	streamsMaxOption            = "net.jessfraz.tor.streams.max"
+	streamsIdleTimeoutOption    = "net.jessfraz.tor.streams.idle_timeout"
+	streamsNetworkMaxOption     = "net.jessfraz.tor.streams.network_max"
+	streamsQueueTimeoutOption   = "net.jessfraz.tor.streams.queue_timeout"
 
 	defaultMTU          = 1500
 	defaultTorContainer = "tor-router"
 )
 
+// Config holds the plugin wide settings of the driver.
+type Config struct {
+	// FirewallBackend is the backend used to program the firewall rules,
+	// either IptablesBackend or NftablesBackend.
+	FirewallBackend string
+	// ReconcileInterval is how often the firewall rules of the networks are
+	// checked for drift, zero disables the checks.
+	ReconcileInterval time.Duration
+	// ReconcileFailClosed takes the bridge of a network down when its rules
+	// drifted, instead of programming them again.
+	ReconcileFailClosed bool
+	// LeakMonitorGroup is the netlink group the dropped packets are logged
+	// to and read back from by the leak monitor, zero disables it.
+	LeakMonitorGroup uint16
+	// DryRun, if set, gets the changes the driver would make to the host
+	// written to it instead of them being made.
+	DryRun io.Writer
+	// DryRunJSON writes the changes of a dry run as JSON lines rather than
+	// text.
+	DryRunJSON bool
+	// ProxyUpstream is the URL of the SOCKS5 proxy, like tor's SocksPort,
+	// the plugin relays the connections of the containers through itself.
+	// If empty they are redirected to the TransPort of the tor router.
+	ProxyUpstream string
+	// ResolverUpstream is the URL of the SOCKS5 proxy the plugin resolves
+	// the dns queries of the containers through, with tor's RESOLVE
+	// extensions. If empty they are forwarded to the DNSPort of the tor
+	// router.
+	ResolverUpstream string
+	// AuditLog is the file the dns queries and the proxied connections of
+	// the containers are logged to as JSON lines, empty disables it.
+	AuditLog string
+	// AuditLogMaxSize is the size in bytes the audit log is rotated at,
+	// zero never rotates it.
+	AuditLogMaxSize int64
+	// AuditLogMaxBackups is how many rotated audit logs are kept.
+	AuditLogMaxBackups int
+	// I2PUpstream is the URL of the HTTP or SOCKS5 proxy of the I2P router
+	// the connections to .i2p names are relayed through.
+	I2PUpstream string
+	// AccountingFile is the file the connections and bytes the transparent
+	// proxy relayed for each endpoint are kept in across restarts, empty
+	// keeps them in memory only.
+	AccountingFile string
+	// RuntimeFile is where the running plugin records the settings its
+	// firewall rules depend on, for Verify to read back instead of
+	// trusting its own flags.
+	RuntimeFile string
+}
+
 // Driver represents the interface for the network plugin driver.
 type Driver struct {
 	network.Driver
 	dcli     *client.Client
+	config   Config
+	firewall firewall
+	host     host
 	networks map[string]*NetworkState
+	routerIP func() (string, error)
+
+	proxyUpstream    *url.URL
+	resolverUpstream *url.URL
+	i2pUpstream      *url.URL
+	audit            *auditLog
+	accounting       *accounting
 	sync.Mutex
 }
 
@@ -58,20 +146,61 @@ type torEndpoint struct {
 	config          *endpointConfiguration // User specified parameters
 	containerConfig *containerConfiguration
 	portMapping     []types.PortBinding // Operation port bindings
+	rateLimit       rateLimit
+	isolationGroup  string
+	sandboxKey      string // where the firewall inside the container is
+	streamLimit     streamLimit
+	container       *containerInfo // looked up when needed
 }
 
 // NetworkState is filled in at network creation time.
 // It contains state that we wish to keep for each network.
 type NetworkState struct {
+	id                    string
 	BridgeName            string
 	MTU                   int
 	Gateway               string
 	GatewayMask           string
 	endpoints             map[string]*torEndpoint // key: endpoint id
 	portMapper            *portmapper.PortMapper
+	firewall              firewall
+	host                  host
+	rules                 []firewallRule    // the policy last programmed
+	failedClosed          bool              // the bridge was taken down as the rules drifted
+	endpointsUnknown      bool              // rebuilt without the endpoints, whose options docker does not keep
+	counters              map[string]uint64 // the counters of the rules when last read
+	subnet                *net.IPNet
 	natChain, filterChain *iptables.ChainInfo
 	iptCleanFuncs         iptablesCleanFuncs
 	blockUDP              bool
+	nflogGroup            uint16
+	bypass                []bypassRule
+	hostAllow             []portSpec
+	sandboxFirewall       bool
+	onionOnly             bool
+	virtualNet            *net.IPNet
+	egressAllow           []string
+	egressDeny            []string
+	rateLimit             rateLimit
+	icc                   bool
+	iccPorts              []portSpec
+	dns                   *dnsServer
+	dnsPolicy             *domainPolicy
+	hostPolicy            *domainPolicy
+	audit                 *auditLog
+	accounting            *accounting
+	isolation             isolation
+	containerInfo         func(endpointID string) (*containerInfo, error)
+	proxyUpstream         *url.URL // where the proxy relays to, nil without one
+	torUpstream           *url.URL // the tor proxy upstream of the plugin
+	resolverUpstream      *url.URL
+	i2p                   string
+	i2pNet                *net.IPNet
+	i2pUpstream           *url.URL
+	i2pAddrs              *i2pAddrMap
+	proxy                 *transparentProxy
+	streamLimit           streamLimit
+	streams               *streamLimiter // nil without the transparent proxy
 	sync.Mutex
 }
 
@@ -84,60 +213,233 @@ func (d *Driver) GetCapabilities() (*network.CapabilitiesResponse, error) {
 func (d *Driver) CreateNetwork(r *network.CreateNetworkRequest) error {
 	logrus.Debugf("Create network request: %+v", r)
 
-	bridgeName, err := getBridgeName(r.NetworkID, r.Options)
-	if err != nil {
-		return err
-	}
-
-	mtu, err := getBridgeMTU(r.Options)
+	ns, err := d.newNetworkState(r.NetworkID, r.Options)
 	if err != nil {
 		return err
 	}
+	bridgeName := ns.BridgeName
 
-	gateway, mask, err := getGatewayIP(r)
+	ns.Gateway, ns.GatewayMask, err = getGatewayIP(r)
 	if err != nil {
 		return err
 	}
 
 	// we need to have ip forwarding setup for this to work w routing
-	if err = setupIPForwarding(); err != nil {
+	if err = ns.host.enableIPForwarding(); err != nil {
 		return err
 	}
 
 	// get tor router ip
-	torIP, err := d.getTorRouterIP()
+	torIP, err := d.routerIP()
 	if err != nil {
 		return err
 	}
 
 	logrus.Debugf("tor router ip is: %s", torIP)
 
-	ns := &NetworkState{
-		BridgeName:  bridgeName,
-		MTU:         mtu,
-		Gateway:     gateway,
-		GatewayMask: mask,
-		endpoints:   map[string]*torEndpoint{},
-		portMapper:  portmapper.New(""),
-		blockUDP:    true, // TODO: this should be configurable
-	}
+	d.Lock()
 	d.networks[r.NetworkID] = ns
-
-	// setup iptables chains
-	ns.natChain, ns.filterChain, err = setupIPChains()
-	if err != nil {
-		return fmt.Errorf("Setup iptables chains failed: %v", err)
-	}
+	d.Unlock()
 
 	logrus.Debugf("Initializing bridge for network %s", r.NetworkID)
 	if err := ns.initBridge(torIP); err != nil {
+		d.Lock()
 		delete(d.networks, r.NetworkID)
+		d.Unlock()
 		return fmt.Errorf("Init bridge %s failed: %v", bridgeName, err)
 	}
 
+	if err := ns.startDNS(); err != nil {
+		if err := ns.deleteBridge(r.NetworkID); err != nil {
+			logrus.Warnf("Failed to delete bridge %s on cleanup: %v", bridgeName, err)
+		}
+		d.Lock()
+		delete(d.networks, r.NetworkID)
+		d.Unlock()
+		return fmt.Errorf("Starting dns server for network %s failed: %v", r.NetworkID, err)
+	}
+
+	if err := ns.startProxy(); err != nil {
+		if err := ns.stopDNS(); err != nil {
+			logrus.Warnf("Failed to stop dns server for network %s on cleanup: %v", r.NetworkID, err)
+		}
+		if err := ns.deleteBridge(r.NetworkID); err != nil {
+			logrus.Warnf("Failed to delete bridge %s on cleanup: %v", bridgeName, err)
+		}
+		d.Lock()
+		delete(d.networks, r.NetworkID)
+		d.Unlock()
+		return fmt.Errorf("Starting transparent proxy for network %s failed: %v", r.NetworkID, err)
+	}
+
 	return nil
 }
 
+// newNetworkState parses the options of a network into its state.
+func (d *Driver) newNetworkState(id string, opts map[string]interface{}) (*NetworkState, error) {
+	bridgeName, err := getBridgeName(id, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	mtu, err := getBridgeMTU(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	bypass, err := getBypassRules(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	hostAllow, err := getHostAllowedPorts(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	onionOnly, virtualNet, err := getOnionOnly(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	sandboxFirewall, err := getSandboxFirewall(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	egressAllow, err := getEgressPorts(opts, egressAllowOption)
+	if err != nil {
+		return nil, err
+	}
+
+	egressDeny, err := getEgressPorts(opts, egressDenyOption)
+	if err != nil {
+		return nil, err
+	}
+
+	rateLimit, err := getRateLimit(opts, rateLimit{})
+	if err != nil {
+		return nil, err
+	}
+
+	icc, iccPorts, err := getICC(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	isolation, err := getIsolation(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	dnsPolicy, err := getDomainPolicy(id, opts, dnsAllowOption, dnsDenyOption, dnsPolicyHits)
+	if err != nil {
+		return nil, err
+	}
+
+	upstream, err := getUpstream(opts)
+	if err != nil {
+		return nil, err
+	}
+	if upstream == nil {
+		upstream = d.proxyUpstream
+	}
+	if isolation.mode != isolateContainer && (d.proxyUpstream == nil || upstream != d.proxyUpstream) {
+		logrus.Warnf("Network %s sets %s, which only applies to the connections the plugin relays to tor with --proxy", id, isolationOption)
+	}
+
+	hostPolicy, err := getDomainPolicy(id, opts, hostsAllowOption, hostsDenyOption, hostPolicyHits)
+	if err != nil {
+		return nil, err
+	}
+	if hostPolicy != nil && upstream == nil {
+		return nil, fmt.Errorf("%s and %s need the plugin to relay the connections with --proxy or %s", hostsAllowOption, hostsDenyOption, upstreamOption)
+	}
+
+	i2p, i2pNet, err := getI2P(opts)
+	if err != nil {
+		return nil, err
+	}
+	var i2pAddrs *i2pAddrMap
+	if i2p != "" {
+		if d.i2pUpstream == nil {
+			return nil, fmt.Errorf("%s needs the plugin to be started with an --i2p-upstream", i2pOption)
+		}
+		if onionOnly {
+			return nil, fmt.Errorf("%s cannot be combined with %s", i2pOption, onionOnlyOption)
+		}
+		if virtualNet != nil && (virtualNet.Contains(i2pNet.IP) || i2pNet.Contains(virtualNet.IP)) {
+			return nil, fmt.Errorf("%s %s overlaps with %s %s", i2pVirtualAddrNetworkOption, i2pNet, virtualAddrNetworkOption, virtualNet)
+		}
+		i2pAddrs = newI2PAddrMap(i2pNet)
+	}
+
+	streams, err := getStreamLimit(opts, streamLimit{})
+	if err != nil {
+		return nil, err
+	}
+	networkStreams, streamQueue, err := getNetworkStreams(opts)
+	if err != nil {
+		return nil, err
+	}
+	var limiter *streamLimiter
+	if upstream != nil || i2p != "" {
+		limiter = newStreamLimiter(networkStreams, streamQueue)
+	} else if streams != (streamLimit{}) || networkStreams > 0 {
+		return nil, fmt.Errorf("%s, %s and %s need the plugin to relay the connections with --proxy or %s", streamsMaxOption, streamsIdleTimeoutOption, streamsNetworkMaxOption, upstreamOption)
+	}
+
+	auditEnabled, err := getAudit(opts)
+	if err != nil {
+		return nil, err
+	}
+	var audit *auditLog
+	if auditEnabled {
+		audit = d.audit
+	}
+
+	return &NetworkState{
+		id:         id,
+		BridgeName: bridgeName,
+		MTU:        mtu,
+		endpoints:  map[string]*torEndpoint{},
+		portMapper: portmapper.New(""),
+		firewall:   d.firewall,
+		host:       d.host,
+		blockUDP:   true, // TODO: this should be configurable
+		nflogGroup: d.config.LeakMonitorGroup,
+		bypass:     bypass,
+		hostAllow:  hostAllow,
+		onionOnly:  onionOnly,
+		virtualNet: virtualNet,
+
+		egressAllow: egressAllow,
+		egressDeny:  egressDeny,
+		rateLimit:   rateLimit,
+		icc:         icc,
+		iccPorts:    iccPorts,
+		isolation:   isolation,
+		dnsPolicy:   dnsPolicy,
+		hostPolicy:  hostPolicy,
+		containerInfo: func(endpointID string) (*containerInfo, error) {
+			return d.containerInfo(id, endpointID)
+		},
+		proxyUpstream:    upstream,
+		torUpstream:      d.proxyUpstream,
+		i2p:              i2p,
+		i2pNet:           i2pNet,
+		i2pUpstream:      d.i2pUpstream,
+		i2pAddrs:         i2pAddrs,
+		resolverUpstream: d.resolverUpstream,
+		audit:            audit,
+		accounting:       d.accounting,
+		streamLimit:      streams,
+		streams:          limiter,
+
+		sandboxFirewall: sandboxFirewall,
+	}, nil
+}
+
 // DeleteNetwork deletes a given tor network.
 func (d *Driver) DeleteNetwork(r *network.DeleteNetworkRequest) error {
 	logrus.Debugf("Delete network request: %+v", r)
@@ -154,11 +456,20 @@ func (d *Driver) DeleteNetwork(r *network.DeleteNetworkRequest) error {
 		return driverapi.ErrNoNetwork(r.NetworkID)
 	}
 
+	if err := ns.stopDNS(); err != nil {
+		logrus.Warnf("Failed to stop dns server for network %s: %v", r.NetworkID, err)
+	}
+	if err := ns.stopProxy(); err != nil {
+		logrus.Warnf("Failed to stop transparent proxy for network %s: %v", r.NetworkID, err)
+	}
+
 	err := ns.deleteBridge(r.NetworkID)
 	if err != nil {
 		return fmt.Errorf("Deleting bridge for network %s failed: %s", r.NetworkID, err)
 	}
+	d.Lock()
 	delete(d.networks, r.NetworkID)
+	d.Unlock()
 
 	return nil
 }
@@ -219,24 +530,45 @@ func (d *Driver) CreateEndpoint(r *network.CreateEndpointRequest) (*network.Crea
 		}
 	}
 	if r.Interface.Address != "" {
-		_, endpoint.addr, err = net.ParseCIDR(r.Interface.Address)
+		endpoint.addr, err = netlink.ParseIPNet(r.Interface.Address)
 		if err != nil {
 			return nil, fmt.Errorf("Parsing %s as CIDR failed: %v", r.Interface.Address, err)
 		}
 	}
 	if r.Interface.AddressIPv6 != "" {
-		_, endpoint.addrv6, err = net.ParseCIDR(r.Interface.AddressIPv6)
+		endpoint.addrv6, err = netlink.ParseIPNet(r.Interface.AddressIPv6)
 		if err != nil {
 			return nil, fmt.Errorf("Parsing %s as CIDR failed: %v", r.Interface.AddressIPv6, err)
 		}
 	}
 
+	endpoint.rateLimit, err = getRateLimit(r.Options, ns.rateLimit)
+	if err != nil {
+		return nil, err
+	}
+	endpoint.isolationGroup, _ = getOption(r.Options, isolationGroupOption)
+	endpoint.streamLimit, err = getStreamLimit(r.Options, ns.streamLimit)
+	if err != nil {
+		return nil, err
+	}
+	if ns.streams == nil && endpoint.streamLimit != ns.streamLimit {
+		err = fmt.Errorf("%s and %s need the plugin to relay the connections with --proxy or %s", streamsMaxOption, streamsIdleTimeoutOption, upstreamOption)
+		return nil, err
+	}
+
 	// Program any required port mapping and store them in the endpoint
 	endpoint.portMapping, err = ns.allocatePorts(epConfig, endpoint, defaultBindingIP, false)
 	if err != nil {
 		return nil, err
 	}
 
+	// Rate limit the endpoint
+	if endpoint.rateLimit.rate > 0 {
+		if err = ns.updateFirewall(); err != nil {
+			return nil, err
+		}
+	}
+
 	return nil, nil
 }
 
@@ -283,6 +615,17 @@ func (d *Driver) DeleteEndpoint(r *network.DeleteEndpointRequest) error {
 		}
 	}()
 
+	if ns.streams != nil {
+		ns.streams.forget(r.EndpointID)
+	}
+
+	// Remove the rate limit of the endpoint
+	if ep.rateLimit.rate > 0 {
+		if err = ns.updateFirewall(); err != nil {
+			return err
+		}
+	}
+
 	// Remove port mappings. Do not stop endpoint delete on unmap failure
 	return ns.releasePorts(ep)
 }
@@ -292,7 +635,7 @@ func (d *Driver) EndpointInfo(r *network.InfoRequest) (*network.InfoResponse, er
 	logrus.Debugf("Endpoint info request: %+v", r)
 
 	res := &network.InfoResponse{
-		Value: make(map[string]string),
+		Value: d.accounting.endpointInfo(r.EndpointID),
 	}
 	return res, nil
 }
@@ -313,31 +656,38 @@ func (d *Driver) Join(r *network.JoinRequest) (*network.JoinResponse, error) {
 		return nil, driverapi.ErrNoNetwork(r.NetworkID)
 	}
 
-	bridgeName := ns.BridgeName
-
-	// create and attach local name to the bridge
-	localVethPair, err := vethPair(truncateID(r.EndpointID), bridgeName)
+	ep, err := ns.getEndpoint(r.EndpointID)
 	if err != nil {
-		return nil, fmt.Errorf("getting vethpair failed: %v", err)
+		return nil, err
 	}
+	if ep == nil {
+		return nil, driverapi.ErrNoEndpoint(r.EndpointID)
+	}
+
+	bridgeName := ns.BridgeName
 
-	if err := netlink.LinkAdd(localVethPair); err != nil {
-		return nil, fmt.Errorf("failed to create the veth pair named: [ %v ] error: [ %s ] ", localVethPair, err)
+	// create and attach local name to the bridge
+	vethName, peerName := vethPair(r.EndpointID)
+	if err := ns.host.addVeth(vethName, peerName, bridgeName); err != nil {
+		return nil, err
 	}
+	logrus.Infof("Attached veth [ %s ] to bridge [ %s ]", vethName, bridgeName)
 
-	// Bring the veth pair up
-	if err := netlink.LinkSetUp(localVethPair); err != nil {
-		return nil, fmt.Errorf("Error enabling Veth local iface: [ %v ]: %v", localVethPair, err)
+	// Firewall the container from the inside as well
+	if err := ns.setupSandboxFirewall(ep, r.SandboxKey); err != nil {
+		if err := ns.host.deleteLink(vethName); err != nil {
+			logrus.Warnf("Failed to delete veth [ %v ] on cleanup: %v", vethName, err)
+		}
+		return nil, fmt.Errorf("Setting up the firewall in sandbox %s failed: %v", r.SandboxKey, err)
 	}
-	logrus.Infof("Attached veth [ %s ] to bridge [ %s ]", localVethPair.Name, bridgeName)
 
 	// SrcName gets renamed to DstPrefix + ID on the container iface
 	res := &network.JoinResponse{
 		InterfaceName: network.InterfaceName{
-			SrcName:   localVethPair.PeerName,
+			SrcName:   peerName,
 			DstPrefix: containerEthName,
 		},
-		Gateway: d.networks[r.NetworkID].Gateway,
+		Gateway: ns.Gateway,
 	}
 	logrus.Debugf("Join endpoint %s:%s to %s", r.NetworkID, r.EndpointID, r.SandboxKey)
 	return res, nil
@@ -359,14 +709,16 @@ func (d *Driver) Leave(r *network.LeaveRequest) error {
 		return driverapi.ErrNoNetwork(r.NetworkID)
 	}
 
-	bridgeName := ns.BridgeName
-
-	localVethPair, err := vethPair(truncateID(r.EndpointID), bridgeName)
-	if err != nil {
-		return fmt.Errorf("getting vethpair failed: %v", err)
+	// Remove the firewall from the container, which may be on other
+	// networks still
+	if ep, err := ns.getEndpoint(r.EndpointID); err == nil && ep != nil {
+		if err := ns.removeSandboxFirewall(ep); err != nil {
+			logrus.Warnf("Removing the firewall of endpoint %s from its sandbox failed: %v", r.EndpointID, err)
+		}
 	}
 
-	if err := netlink.LinkDel(localVethPair); err != nil {
+	vethName, _ := vethPair(r.EndpointID)
+	if err := ns.host.deleteLink(vethName); err != nil {
 		return fmt.Errorf("unable to delete veth on leave: %s", err)
 	}
 
@@ -385,7 +737,53 @@ func (d *Driver) RevokeExternalConnectivity(r *network.RevokeExternalConnectivit
 }
 
 // NewDriver creates a new Driver pointer.
-func NewDriver() (*Driver, error) {
+func NewDriver(config Config) (*Driver, error) {
+	d, err := newDriver(config)
+	if err != nil {
+		return nil, err
+	}
+
+	if config.ReconcileInterval > 0 {
+		go d.reconcile(config.ReconcileInterval, config.ReconcileFailClosed)
+	}
+
+	go d.collectCounters(counterInterval)
+
+	if config.RuntimeFile != "" && config.DryRun == nil {
+		if err := writeRuntimeConfig(config); err != nil {
+			return nil, err
+		}
+	}
+
+	if config.LeakMonitorGroup > 0 && config.DryRun == nil {
+		go func() {
+			if err := d.monitorLeaks(config.LeakMonitorGroup); err != nil {
+				logrus.Errorf("Leak monitor stopped: %v", err)
+			}
+		}()
+	}
+
+	return d, nil
+}
+
+// newDriver creates a driver without starting any of its background work.
+func newDriver(config Config) (*Driver, error) {
+	var (
+		fw firewall
+		h  host
+	)
+	if config.DryRun != nil {
+		dr := newDryRun(config.DryRun, config.DryRunJSON)
+		fw, h = dr, dr
+	} else {
+		var err error
+		fw, err = newFirewall(config.FirewallBackend)
+		if err != nil {
+			return nil, err
+		}
+		h = systemHost{}
+	}
+
 	defaultHeaders := map[string]string{"User-Agent": "engine-api-cli-1.0"}
 	dcli, err := client.NewClient("unix:///var/run/docker.sock", "", nil, defaultHeaders)
 	if err != nil {
@@ -394,7 +792,61 @@ func NewDriver() (*Driver, error) {
 
 	d := &Driver{
 		dcli:     dcli,
+		config:   config,
+		firewall: fw,
+		host:     h,
 		networks: make(map[string]*NetworkState),
 	}
+	d.routerIP = d.getTorRouterIP
+
+	if config.ProxyUpstream != "" {
+		d.proxyUpstream, err = parseProxyUpstream(config.ProxyUpstream, "socks5")
+		if err != nil {
+			return nil, err
+		}
+		if d.proxyUpstream.User != nil {
+			logrus.Warnf("The proxy upstream has credentials, the streams of the containers are not isolated from each other")
+		}
+	}
+
+	if config.ResolverUpstream != "" {
+		d.resolverUpstream, err = parseProxyUpstream(config.ResolverUpstream, "socks5")
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if config.I2PUpstream != "" {
+		d.i2pUpstream, err = parseProxyUpstream(config.I2PUpstream, "http", "socks5")
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if config.AuditLog != "" && config.DryRun == nil {
+		d.audit, err = newAuditLog(config.AuditLog, config.AuditLogMaxSize, config.AuditLogMaxBackups)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	accountingFile := config.AccountingFile
+	if config.DryRun != nil {
+		accountingFile = ""
+	}
+	d.accounting, err = newAccounting(accountingFile)
+	if err != nil {
+		return nil, err
+	}
+
 	return d, nil
 }
+
+// Close writes out the accounting of the endpoints, for the plugin to pick
+// it up again once it is restarted.
+func (d *Driver) Close() error {
+	if err := d.accounting.save(); err != nil {
+		return fmt.Errorf("Saving the accounting file failed: %v", err)
+	}
+	return nil
+}
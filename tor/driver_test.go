@@ -0,0 +1,267 @@
+package tor
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/docker/go-plugins-helpers/network"
+	"github.com/docker/libnetwork/netlabel"
+)
+
+// newDryRunDriver creates a driver that records what it does to the host.
+func newDryRunDriver(t *testing.T, json bool) (*Driver, *dryRun, *bytes.Buffer) {
+	var b bytes.Buffer
+	d, err := newDriver(Config{DryRun: &b, DryRunJSON: json})
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.routerIP = func() (string, error) { return "172.17.0.2", nil }
+	return d, d.host.(*dryRun), &b
+}
+
+func TestDriverDryRun(t *testing.T) {
+	d, dr, _ := newDryRunDriver(t, false)
+
+	if err := d.CreateNetwork(&network.CreateNetworkRequest{
+		NetworkID: "0123456789abcdef",
+		IPv4Data:  []*network.IPAMData{{Gateway: "172.18.0.1/16"}},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.CreateEndpoint(&network.CreateEndpointRequest{
+		NetworkID:  "0123456789abcdef",
+		EndpointID: "fedcba9876543210",
+		Interface:  &network.EndpointInterface{Address: "172.18.0.2/16"},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.Join(&network.JoinRequest{
+		NetworkID:  "0123456789abcdef",
+		EndpointID: "fedcba9876543210",
+		SandboxKey: "/var/run/docker/netns/1",
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Leave(&network.LeaveRequest{
+		NetworkID:  "0123456789abcdef",
+		EndpointID: "fedcba9876543210",
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.DeleteEndpoint(&network.DeleteEndpointRequest{
+		NetworkID:  "0123456789abcdef",
+		EndpointID: "fedcba9876543210",
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.DeleteNetwork(&network.DeleteNetworkRequest{NetworkID: "0123456789abcdef"}); err != nil {
+		t.Fatal(err)
+	}
+
+	var changes []string
+	for _, c := range dr.changes {
+		changes = append(changes, c.String())
+	}
+	recorded := strings.Join(changes, "\n")
+
+	// the changes have to be made in this order
+	expected := []string{
+		"add bridge torbr-01234: mtu 1500",
+		"add address torbr-01234: 172.18.0.1/16",
+		"set sysctl net.ipv6.conf.torbr-01234.disable_ipv6: 1",
+		"set link torbr-01234: up",
+		"flush rules torbr-01234",
+		"add rule torbr-01234: -t nat -A PREROUTING -i torbr-01234 -p tcp --syn -j REDIRECT --to-ports 22340",
+		// the flushed direct flows are cut rather than forwarded as is
+		"add rule torbr-01234: -t filter -A FORWARD -i torbr-01234 ! -o torbr-01234 -p tcp ! --syn -m conntrack --ctstate NEW -j REJECT --reject-with tcp-reset",
+		"add rule torbr-01234: -t filter -A FORWARD -i torbr-01234 ! -o torbr-01234 -j ACCEPT",
+		"flush conntrack 172.18.0.0/16: flows going around tor",
+		"listen dns 172.18.0.1:22354",
+		"add veth tor-veth0-fedcb: peer ethcfedcb master torbr-01234",
+		"program sandbox-iptables /var/run/docker/netns/1: -I OUTPUT -s 172.18.0.2 -j ONION-OUT-fedcba987654",
+		"delete sandbox-iptables /var/run/docker/netns/1: ONION-OUT-fedcba987654",
+		"delete link tor-veth0-fedcb",
+		"delete link torbr-01234",
+		"delete rules torbr-01234",
+	}
+	last := 0
+	for _, e := range expected {
+		i := strings.Index(recorded[last:], e)
+		if i < 0 {
+			t.Fatalf("expected change %q after the first %d bytes of:\n%s", e, last, recorded)
+		}
+		last += i + len(e)
+	}
+
+	if len(dr.links) != 0 {
+		t.Fatalf("expected every link to be deleted, got %v", dr.links)
+	}
+}
+
+func TestDriverDryRunJSON(t *testing.T) {
+	d, dr, b := newDryRunDriver(t, true)
+
+	if err := d.CreateNetwork(&network.CreateNetworkRequest{
+		NetworkID: "0123456789abcdef",
+		IPv4Data:  []*network.IPAMData{{Gateway: "172.18.0.1/16"}},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	defer d.DeleteNetwork(&network.DeleteNetworkRequest{NetworkID: "0123456789abcdef"})
+
+	lines := strings.Split(strings.TrimSpace(b.String()), "\n")
+	if len(lines) != len(dr.changes) {
+		t.Fatalf("expected %d lines, got %d:\n%s", len(dr.changes), len(lines), b.String())
+	}
+	for i, l := range lines {
+		var c change
+		if err := json.Unmarshal([]byte(l), &c); err != nil {
+			t.Fatalf("decoding %q failed: %v", l, err)
+		}
+		if c != dr.changes[i] {
+			t.Fatalf("expected change %v, got %v", dr.changes[i], c)
+		}
+	}
+}
+
+func TestCreateEndpointStreamLimitWithoutProxy(t *testing.T) {
+	d, _, _ := newDryRunDriver(t, false)
+
+	if err := d.CreateNetwork(&network.CreateNetworkRequest{
+		NetworkID: "0123456789abcdef",
+		IPv4Data:  []*network.IPAMData{{Gateway: "172.18.0.1/16"}},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	defer d.DeleteNetwork(&network.DeleteNetworkRequest{NetworkID: "0123456789abcdef"})
+
+	if _, err := d.CreateEndpoint(&network.CreateEndpointRequest{
+		NetworkID:  "0123456789abcdef",
+		EndpointID: "fedcba9876543210",
+		Interface:  &network.EndpointInterface{Address: "172.18.0.2/16"},
+		Options: map[string]interface{}{netlabel.GenericData: map[string]string{
+			streamsMaxOption: "4",
+		}},
+	}); err == nil {
+		t.Fatal("expected a stream limit without the proxy to be rejected")
+	}
+
+	ns := d.networks["0123456789abcdef"]
+	ns.Lock()
+	defer ns.Unlock()
+	if _, ok := ns.endpoints["fedcba9876543210"]; ok {
+		t.Fatal("expected the rejected endpoint not to be registered")
+	}
+}
+
+// failingFirewall fails to program any rule.
+type failingFirewall struct {
+	firewall
+}
+
+func (failingFirewall) program(n *NetworkState, rules []firewallRule) error {
+	return errors.New("iptables: not available")
+}
+
+func TestCreateNetworkFirewallFailure(t *testing.T) {
+	d, dr, _ := newDryRunDriver(t, false)
+	req := &network.CreateNetworkRequest{
+		NetworkID: "0123456789abcdef",
+		IPv4Data:  []*network.IPAMData{{Gateway: "172.18.0.1/16"}},
+	}
+
+	// the bridge does not outlive the firewall failing
+	d.firewall = failingFirewall{d.firewall}
+	if err := d.CreateNetwork(req); err == nil {
+		t.Fatal("expected the network to fail without a firewall")
+	}
+	if len(dr.links) != 0 {
+		t.Fatalf("expected the bridge to be deleted, got %v", dr.links)
+	}
+
+	// a bridge that is already there still gets its rules
+	d.firewall = dr
+	if err := dr.addBridge("torbr-01234", 1500, "172.18.0.1/16"); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.CreateNetwork(req); err != nil {
+		t.Fatal(err)
+	}
+	defer d.DeleteNetwork(&network.DeleteNetworkRequest{NetworkID: "0123456789abcdef"})
+	if len(dr.rules["torbr-01234"]) == 0 {
+		t.Fatal("expected the rules of the existing bridge to be programmed")
+	}
+}
+
+func TestRuntimeConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "onion-runtime")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "onion.json")
+
+	running := Config{
+		FirewallBackend:  NftablesBackend,
+		LeakMonitorGroup: 5,
+		ProxyUpstream:    "socks5://127.0.0.1:9050",
+		RuntimeFile:      path,
+	}
+	if err := writeRuntimeConfig(running); err != nil {
+		t.Fatal(err)
+	}
+
+	// the flags of the verify command are overridden
+	config, err := readRuntimeConfig(Config{FirewallBackend: IptablesBackend, RuntimeFile: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.FirewallBackend != NftablesBackend || config.LeakMonitorGroup != 5 || config.ProxyUpstream != running.ProxyUpstream {
+		t.Fatalf("expected the settings of the running plugin, got %+v", config)
+	}
+
+	if _, err := readRuntimeConfig(Config{RuntimeFile: filepath.Join(dir, "missing.json")}); err == nil {
+		t.Fatal("expected an error without the settings of the running plugin")
+	}
+}
+
+func TestReconcileFailClosed(t *testing.T) {
+	d, dr, _ := newDryRunDriver(t, false)
+
+	if err := d.CreateNetwork(&network.CreateNetworkRequest{
+		NetworkID: "0123456789abcdef",
+		IPv4Data:  []*network.IPAMData{{Gateway: "172.18.0.1/16"}},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	defer d.DeleteNetwork(&network.DeleteNetworkRequest{NetworkID: "0123456789abcdef"})
+	ns := d.networks["0123456789abcdef"]
+	firewallDrift.Set("0123456789abcdef", new(expvar.Int))
+
+	// something wiped the rules
+	delete(dr.rules, ns.BridgeName)
+	ns.reconcileFirewall("0123456789abcdef", true)
+	if dr.links[ns.BridgeName].up {
+		t.Fatal("expected the bridge to be taken down")
+	}
+
+	// the next tick programs the rules and brings the bridge back up,
+	// without counting the drift again
+	ns.reconcileFirewall("0123456789abcdef", true)
+	if !dr.links[ns.BridgeName].up {
+		t.Fatal("expected the bridge to be brought back up")
+	}
+	if len(dr.rules[ns.BridgeName]) == 0 {
+		t.Fatal("expected the rules to be programmed again")
+	}
+	if v := firewallDrift.Get("0123456789abcdef"); v == nil || v.String() != "1" {
+		t.Fatalf("expected the drift to be counted once, got %v", v)
+	}
+}
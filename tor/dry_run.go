@@ -0,0 +1,258 @@
+package tor
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+	"github.com/vishvananda/netlink"
+)
+
+// change is a change the driver would make to the host.
+type change struct {
+	Action string `json:"action"`
+	Object string `json:"object"`
+	Name   string `json:"name"`
+	Detail string `json:"detail,omitempty"`
+}
+
+func (c change) String() string {
+	s := c.Action + " " + c.Object + " " + c.Name
+	if c.Detail != "" {
+		s += ": " + c.Detail
+	}
+	return s
+}
+
+// dryRunLink is a link the dry run created.
+type dryRunLink struct {
+	addr *net.IPNet
+	up   bool
+}
+
+// dryRun is the host and the firewall of a dry run. It writes down the
+// changes instead of making them and keeps track of what it would have
+// created, so the driver works as usual on top of it.
+type dryRun struct {
+	w       io.Writer
+	json    bool
+	changes []change
+	links   map[string]*dryRunLink
+	rules   map[string][]firewallRule // key: bridge name
+	sync.Mutex
+}
+
+func newDryRun(w io.Writer, json bool) *dryRun {
+	return &dryRun{
+		w:     w,
+		json:  json,
+		links: map[string]*dryRunLink{},
+		rules: map[string][]firewallRule{},
+	}
+}
+
+// record writes the change down. The caller holds the lock.
+func (d *dryRun) record(action, object, name, detail string) {
+	c := change{Action: action, Object: object, Name: name, Detail: detail}
+	d.changes = append(d.changes, c)
+
+	if d.json {
+		b, err := json.Marshal(c)
+		if err != nil {
+			logrus.Warnf("Encoding dry run change %s failed: %v", c, err)
+			return
+		}
+		fmt.Fprintf(d.w, "%s\n", b)
+		return
+	}
+	fmt.Fprintln(d.w, c)
+}
+
+func (d *dryRun) enableIPForwarding() error {
+	// reading the current setting is harmless
+	data, err := ioutil.ReadFile(ipv4ForwardConf)
+	if err == nil && len(data) > 0 && data[0] == '1' {
+		return nil
+	}
+
+	d.Lock()
+	defer d.Unlock()
+	d.record("set", "sysctl", "net.ipv4.ip_forward", "1")
+	return nil
+}
+
+func (d *dryRun) linkExists(name string) (bool, error) {
+	d.Lock()
+	defer d.Unlock()
+	_, ok := d.links[name]
+	return ok, nil
+}
+
+func (d *dryRun) addBridge(name string, mtu int, addr string) error {
+	ipnet, err := netlink.ParseIPNet(addr)
+	if err != nil {
+		return err
+	}
+
+	d.Lock()
+	defer d.Unlock()
+	d.links[name] = &dryRunLink{addr: ipnet, up: true}
+	d.record("add", "bridge", name, fmt.Sprintf("mtu %d", mtu))
+	d.record("add", "address", name, addr)
+	d.record("set", "sysctl", "net.ipv6.conf."+name+".disable_ipv6", "1")
+	d.record("set", "link", name, "up")
+	return nil
+}
+
+func (d *dryRun) addVeth(name, peer, bridge string) error {
+	d.Lock()
+	defer d.Unlock()
+	if _, ok := d.links[bridge]; !ok {
+		return fmt.Errorf("Link %s not found", bridge)
+	}
+	d.links[name] = &dryRunLink{up: true}
+	d.record("add", "veth", name, fmt.Sprintf("peer %s master %s", peer, bridge))
+	d.record("set", "link", name, "up")
+	return nil
+}
+
+func (d *dryRun) deleteLink(name string) error {
+	d.Lock()
+	defer d.Unlock()
+	if _, ok := d.links[name]; !ok {
+		return fmt.Errorf("Getting link with name %s failed: Link not found", name)
+	}
+	delete(d.links, name)
+	d.record("delete", "link", name, "")
+	return nil
+}
+
+func (d *dryRun) setLinkDown(name string) error {
+	d.Lock()
+	defer d.Unlock()
+	l, ok := d.links[name]
+	if !ok {
+		return fmt.Errorf("Link %s not found", name)
+	}
+	l.up = false
+	d.record("set", "link", name, "down")
+	return nil
+}
+
+func (d *dryRun) setLinkUp(name string) error {
+	d.Lock()
+	defer d.Unlock()
+	l, ok := d.links[name]
+	if !ok {
+		return fmt.Errorf("Link %s not found", name)
+	}
+	l.up = true
+	d.record("set", "link", name, "up")
+	return nil
+}
+
+func (d *dryRun) ifaceAddr(name string) (*net.IPNet, error) {
+	d.Lock()
+	defer d.Unlock()
+	l, ok := d.links[name]
+	if !ok {
+		return nil, fmt.Errorf("Link %s not found", name)
+	}
+	if l.addr == nil {
+		return nil, fmt.Errorf("Interface %s has no IP addresses", name)
+	}
+	return l.addr, nil
+}
+
+func (d *dryRun) flushConntrack(subnet *net.IPNet) error {
+	d.Lock()
+	defer d.Unlock()
+	d.record("flush", "conntrack", subnet.String(), "flows going around tor")
+	return nil
+}
+
+func (d *dryRun) setupSandboxFirewall(sandboxKey string, rules sandboxRules) error {
+	d.Lock()
+	defer d.Unlock()
+	d.record("program", "sandbox-iptables", sandboxKey, fmt.Sprintf("-I OUTPUT -s %s -j %s\n%s", rules.src, rules.chain, strings.TrimSpace(rules.script)))
+	if rules.src6 != "" {
+		d.record("program", "sandbox-ip6tables", sandboxKey, fmt.Sprintf("-I OUTPUT -s %s -j %s\n%s", rules.src6, rules.chain, strings.TrimSpace(rules.script6)))
+	}
+	return nil
+}
+
+func (d *dryRun) removeSandboxFirewall(sandboxKey string, rules sandboxRules) error {
+	d.Lock()
+	defer d.Unlock()
+	d.record("delete", "sandbox-iptables", sandboxKey, rules.chain)
+	if rules.src6 != "" {
+		d.record("delete", "sandbox-ip6tables", sandboxKey, rules.chain)
+	}
+	return nil
+}
+
+// listenAddr keeps the servers of the driver off the address, which only
+// exists on the recorded bridge, and serves them on a random local port.
+func (d *dryRun) listenAddr(service, addr string) string {
+	d.Lock()
+	defer d.Unlock()
+	d.record("listen", service, addr, "")
+	return "127.0.0.1:0"
+}
+
+func (d *dryRun) program(n *NetworkState, rules []firewallRule) error {
+	d.Lock()
+	defer d.Unlock()
+	d.rules[n.BridgeName] = rules
+	d.record("flush", "rules", n.BridgeName, "")
+	for _, r := range rules {
+		d.record("add", "rule", n.BridgeName, r.String())
+	}
+	return nil
+}
+
+func (d *dryRun) cleanup(n *NetworkState) error {
+	d.Lock()
+	defer d.Unlock()
+	delete(d.rules, n.BridgeName)
+	d.record("delete", "rules", n.BridgeName, "")
+	return nil
+}
+
+func (d *dryRun) check(n *NetworkState, rules []firewallRule) ([]firewallRule, error) {
+	d.Lock()
+	defer d.Unlock()
+	programmed := map[string]bool{}
+	for _, r := range d.rules[n.BridgeName] {
+		programmed[r.String()] = true
+	}
+	var missing []firewallRule
+	for _, r := range rules {
+		if !programmed[r.String()] {
+			missing = append(missing, r)
+		}
+	}
+	return missing, nil
+}
+
+func (d *dryRun) shadowed(n *NetworkState) ([]string, error) {
+	return nil, nil
+}
+
+// counters returns nothing matched for the recorded rules.
+func (d *dryRun) counters(n *NetworkState) (map[string]uint64, error) {
+	d.Lock()
+	defer d.Unlock()
+	counters := map[string]uint64{}
+	for _, r := range d.rules[n.BridgeName] {
+		if r.comment != "" {
+			counters[r.comment] = 0
+		}
+	}
+	return counters, nil
+}
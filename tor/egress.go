@@ -0,0 +1,81 @@
+package tor
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// getEgressPorts parses an egress option. It is a comma separated list of
+// tcp destination ports or port ranges, for example "25,465,6660-6669". The
+// ranges are returned in the first:last form of the firewall rules.
+func getEgressPorts(opts map[string]interface{}, option string) ([]string, error) {
+	v, ok := getOption(opts, option)
+	if !ok {
+		return nil, nil
+	}
+
+	var ports []string
+	for _, entry := range strings.Split(v, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		port, err := parsePortRange(entry)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid %s entry %q: %v", option, entry, err)
+		}
+		ports = append(ports, port)
+	}
+	return ports, nil
+}
+
+func parsePortRange(entry string) (string, error) {
+	first, last := entry, entry
+	if i := strings.Index(entry, "-"); i != -1 {
+		first, last = entry[:i], entry[i+1:]
+	}
+
+	f, err := strconv.Atoi(first)
+	if err != nil || f < 1 || f > 65535 {
+		return "", fmt.Errorf("invalid port %q", first)
+	}
+	l, err := strconv.Atoi(last)
+	if err != nil || l < 1 || l > 65535 {
+		return "", fmt.Errorf("invalid port %q", last)
+	}
+	if l < f {
+		return "", fmt.Errorf("invalid port range")
+	}
+
+	if f == l {
+		return first, nil
+	}
+	return first + ":" + last, nil
+}
+
+// restrictEgress keeps the tcp connections to the denied ports, or to the
+// ports that are not allowed, from being redirected into tor and resets
+// them instead of letting them time out. The rules have to come ahead of
+// the redirect rules and the forward rules.
+func (fc *firewallConfig) restrictEgress() []firewallRule {
+	var rules []firewallRule
+	for _, port := range fc.egressDeny {
+		rules = append(rules,
+			// skip the redirect to tor
+			firewallRule{table: "nat", chain: "PREROUTING", in: fc.bridgeName,
+				proto: "tcp", dport: port, target: "RETURN"},
+			firewallRule{table: "filter", chain: "FORWARD", in: fc.bridgeName, out: "!" + fc.bridgeName,
+				proto: "tcp", dport: port, target: "REJECT", rejectWith: "tcp-reset"},
+		)
+	}
+
+	// with an allow list only the allowed ports are redirected, reset
+	// whatever else would be forwarded
+	if len(fc.egressAllow) > 0 {
+		rules = append(rules, firewallRule{table: "filter", chain: "FORWARD", in: fc.bridgeName,
+			out: "!" + fc.bridgeName, proto: "tcp", target: "REJECT", rejectWith: "tcp-reset"})
+	}
+
+	return rules
+}
@@ -0,0 +1,63 @@
+package tor
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestGetEgressPorts(t *testing.T) {
+	ports, err := getEgressPorts(map[string]interface{}{egressDenyOption: "25, 6660-6669,465-465"}, egressDenyOption)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"25", "6660:6669", "465"}
+	if strings.Join(ports, ",") != strings.Join(expected, ",") {
+		t.Fatalf("expected ports %v, got %v", expected, ports)
+	}
+
+	for _, v := range []string{"0", "smtp", "100-1", "1-65536"} {
+		if _, err := getEgressPorts(map[string]interface{}{egressDenyOption: v}, egressDenyOption); err == nil {
+			t.Errorf("expected error parsing %q", v)
+		}
+	}
+}
+
+func TestEgressRules(t *testing.T) {
+	_, addr, _ := net.ParseCIDR("172.18.0.0/16")
+	fc := &firewallConfig{
+		bridgeName:  "torbr-1",
+		transPort:   torTransparentProxyPort,
+		addr:        addr,
+		dnsPort:     torDNSPort,
+		egressAllow: []string{"80", "443"},
+		egressDeny:  []string{"25"},
+	}
+
+	var rules []string
+	for _, r := range fc.rules() {
+		rules = append(rules, r.String())
+	}
+	script := strings.Join(rules, "\n") + "\n"
+
+	// in the order they have to be evaluated in
+	expected := []string{
+		"-t nat -A PREROUTING -i torbr-1 -p tcp --dport 25 -j RETURN",
+		"-t filter -A FORWARD -i torbr-1 ! -o torbr-1 -p tcp --dport 25 -j REJECT --reject-with tcp-reset",
+		"-t filter -A FORWARD -i torbr-1 ! -o torbr-1 -p tcp -j REJECT --reject-with tcp-reset",
+		"-t nat -A PREROUTING -i torbr-1 -p tcp --dport 80 --syn -j REDIRECT --to-ports 22340",
+		"-t nat -A PREROUTING -i torbr-1 -p tcp --dport 443 --syn -j REDIRECT --to-ports 22340",
+		"-t filter -A FORWARD -i torbr-1 ! -o torbr-1 -j ACCEPT",
+	}
+	last := 0
+	for _, e := range expected {
+		i := strings.Index(script[last:], e+"\n")
+		if i < 0 {
+			t.Fatalf("expected rule %q after the first %d bytes of:\n%s", e, last, script)
+		}
+		last += i + len(e)
+	}
+	if strings.Contains(script, "-p tcp --syn -j REDIRECT") {
+		t.Fatalf("expected no redirect of every port with an allow list:\n%s", script)
+	}
+}
@@ -0,0 +1,173 @@
+package tor
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+const (
+	// IptablesBackend programs the firewall rules with iptables.
+	IptablesBackend = "iptables"
+	// NftablesBackend programs the firewall rules with nftables.
+	NftablesBackend = "nftables"
+)
+
+// firewall programs the policy of a tor network on the host.
+type firewall interface {
+	// program sets up the rules for the network, in the order given.
+	program(n *NetworkState, rules []firewallRule) error
+	// cleanup removes everything program set up for the network.
+	cleanup(n *NetworkState) error
+	// check returns the rules of the network that are not programmed.
+	check(n *NetworkState, rules []firewallRule) ([]firewallRule, error)
+	// shadowed returns the rules of others that are evaluated before the
+	// network's and could let its traffic around tor.
+	shadowed(n *NetworkState) ([]string, error)
+	// counters returns the packets matched by the rules of the network
+	// that have a comment, keyed by comment. They start over when the
+	// rules are programmed.
+	counters(n *NetworkState) (map[string]uint64, error)
+}
+
+func newFirewall(backend string) (firewall, error) {
+	switch backend {
+	case "", IptablesBackend:
+		return &iptablesFirewall{}, nil
+	case NftablesBackend:
+		return &nftablesFirewall{}, nil
+	}
+	return nil, fmt.Errorf("unknown firewall backend %q, must be one of %s or %s", backend, IptablesBackend, NftablesBackend)
+}
+
+// firewallRule is a single rule of a tor network's policy. The policy is
+// described in terms of the iptables tables and chains, each backend renders
+// it in its own syntax.
+type firewallRule struct {
+	table string // nat or filter
+	chain string // PREROUTING, POSTROUTING, FORWARD or INPUT
+
+	// Matches, an empty field matches anything. The interfaces can be
+	// prefixed with "!" to negate the match and the ports can be ranges
+	// in the form first:last.
+	in       string
+	out      string
+	src      string
+	dst      string
+	proto    string
+	sport    string
+	dport    string
+	syn      bool
+	notSyn   bool // matches the tcp packets other than syns
+	ctstate  []string
+	srcLocal bool
+
+	// rateAbove matches the packets above the rate a second, with bursts
+	// up to rateBurst, counted in the bucket named rateName.
+	rateAbove int
+	rateBurst int
+	rateName  string
+
+	comment string // identifies the rule to read its counters
+
+	target      string // ACCEPT, DROP, REJECT, RETURN, REDIRECT, MASQUERADE or NFLOG
+	toPort      string // the port to REDIRECT to
+	rejectWith  string // the icmp error or tcp-reset to REJECT with
+	nflogGroup  uint16 // the netlink group to NFLOG to
+	nflogPrefix string
+}
+
+func (r firewallRule) String() string {
+	return fmt.Sprintf("-t %s -A %s %s", r.table, r.chain, strings.Join(r.iptablesArgs(), " "))
+}
+
+// ruleTagPrefix starts the tag in the comment of every rule the plugin
+// programs in the chains of a network.
+const ruleTagPrefix = "onion:"
+
+// ruleTag returns the tag of the rule rendered as given, a digest of it, so
+// a rule that was changed no longer carries the tag of the rule it
+// replaced.
+func ruleTag(rendered string) string {
+	sum := sha256.Sum256([]byte(rendered))
+	return ruleTagPrefix + hex.EncodeToString(sum[:6])
+}
+
+// splitRuleComment splits the comment of a programmed rule into the comment
+// of the rule of the policy and its tag.
+func splitRuleComment(comment string) (string, string) {
+	i := strings.LastIndex(comment, ruleTagPrefix)
+	if i < 0 {
+		return comment, ""
+	}
+	return strings.TrimSpace(comment[:i]), comment[i:]
+}
+
+// driftedRules compares the rules programmed in a chain, given by their
+// comments in order, with the rules expected there, tagged by tag. It
+// returns the expected rules that are missing, or all of them if the chain
+// holds other rules or has them in another order.
+func driftedRules(expected []firewallRule, comments []string, tag func(firewallRule) (string, error)) ([]firewallRule, error) {
+	want := make([]string, 0, len(expected))
+	for _, r := range expected {
+		t, err := tag(r)
+		if err != nil {
+			return nil, err
+		}
+		want = append(want, t)
+	}
+	have := make([]string, 0, len(comments))
+	for _, c := range comments {
+		_, t := splitRuleComment(c)
+		have = append(have, t)
+	}
+	if equalStrings(have, want) {
+		return nil, nil
+	}
+
+	found := map[string]bool{}
+	for _, t := range have {
+		found[t] = true
+	}
+	var missing []firewallRule
+	for i, r := range expected {
+		if !found[want[i]] {
+			missing = append(missing, r)
+		}
+	}
+	if len(missing) == 0 {
+		// all the rules are there but others were added to the chain or
+		// they were moved around
+		missing = expected
+	}
+	return missing, nil
+}
+
+// driftedRules compares the rules programmed in a chain of the network with
+// the rules expected there, leaving out the rate limits of the endpoints if
+// those are not known.
+func (n *NetworkState) driftedRules(expected []firewallRule, comments []string, tag func(firewallRule) (string, error)) ([]firewallRule, error) {
+	if n.endpointsUnknown {
+		var known []string
+		for _, c := range comments {
+			if comment, _ := splitRuleComment(c); !strings.HasPrefix(comment, rateLimitCommentPrefix) {
+				known = append(known, c)
+			}
+		}
+		comments = known
+	}
+	return driftedRules(expected, comments, tag)
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
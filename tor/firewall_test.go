@@ -0,0 +1,282 @@
+package tor
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestFirewallRuleRendering(t *testing.T) {
+	testCases := []struct {
+		rule     firewallRule
+		iptables string
+		nft      string
+	}{
+		{
+			rule:     firewallRule{table: "nat", chain: "PREROUTING", in: "torbr-1", proto: "tcp", syn: true, target: "REDIRECT", toPort: "22340"},
+			iptables: "-i torbr-1 -p tcp --syn -j REDIRECT --to-ports 22340",
+			nft:      `iifname "torbr-1" tcp flags & (fin|syn|rst|ack) == syn redirect to :22340`,
+		},
+		{
+			rule:     firewallRule{table: "nat", chain: "POSTROUTING", src: "172.18.0.0/16", out: "!torbr-1", target: "MASQUERADE"},
+			iptables: "! -o torbr-1 -s 172.18.0.0/16 -j MASQUERADE",
+			nft:      `oifname != "torbr-1" ip saddr 172.18.0.0/16 masquerade`,
+		},
+		{
+			rule:     firewallRule{table: "filter", chain: "FORWARD", in: "torbr-1", proto: "tcp", notSyn: true, ctstate: []string{"NEW"}, target: "REJECT", rejectWith: "tcp-reset"},
+			iptables: "-i torbr-1 -p tcp ! --syn -m conntrack --ctstate NEW -j REJECT --reject-with tcp-reset",
+			nft:      `iifname "torbr-1" tcp flags & (fin|syn|rst|ack) != syn ct state new reject with tcp reset`,
+		},
+		{
+			rule:     firewallRule{table: "filter", chain: "FORWARD", out: "torbr-1", proto: "udp", target: "DROP"},
+			iptables: "-o torbr-1 -p udp -j DROP",
+			nft:      `oifname "torbr-1" meta l4proto udp drop`,
+		},
+		{
+			rule:     firewallRule{table: "filter", chain: "INPUT", in: "torbr-1", ctstate: []string{"RELATED", "ESTABLISHED"}, target: "ACCEPT"},
+			iptables: "-i torbr-1 -m conntrack --ctstate RELATED,ESTABLISHED -j ACCEPT",
+			nft:      `iifname "torbr-1" ct state related,established accept`,
+		},
+		{
+			rule:     firewallRule{table: "filter", chain: "FORWARD", out: "torbr-1", src: "10.0.0.1/32", proto: "tcp", sport: "5432", target: "ACCEPT"},
+			iptables: "-o torbr-1 -s 10.0.0.1/32 -p tcp --sport 5432 -j ACCEPT",
+			nft:      `oifname "torbr-1" ip saddr 10.0.0.1/32 tcp sport 5432 accept`,
+		},
+	}
+
+	for _, tc := range testCases {
+		if args := strings.Join(tc.rule.iptablesArgs(), " "); args != tc.iptables {
+			t.Errorf("expected iptables args %q, got %q", tc.iptables, args)
+		}
+		expr, err := tc.rule.nftExpr()
+		if err != nil {
+			t.Errorf("rendering %s for nftables failed: %v", tc.rule, err)
+			continue
+		}
+		if expr != tc.nft {
+			t.Errorf("expected nftables expression %q, got %q", tc.nft, expr)
+		}
+	}
+}
+
+func TestNftScript(t *testing.T) {
+	fc := &firewallConfig{
+		bridgeName: "torbr-1",
+		transPort:  torTransparentProxyPort,
+		addr:       &net.IPNet{IP: net.IPv4(172, 18, 0, 0), Mask: net.CIDRMask(16, 32)},
+		icc:        true,
+		ipMasqMode: true,
+		blockUDP:   true,
+	}
+
+	script, err := nftScript(nftTableName(fc.bridgeName), fc.rules())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.HasPrefix(script, "table ip onion_torbr_1\ndelete table ip onion_torbr_1\n") {
+		t.Fatalf("expected the script to replace the table, got:\n%s", script)
+	}
+	// every rule of the policy has to be in the script
+	for _, r := range fc.rules() {
+		expr, _ := r.nftExpr()
+		if !strings.Contains(script, expr) {
+			t.Errorf("expected rule %q in script:\n%s", expr, script)
+		}
+	}
+	// the redirects have to come before the input drop
+	if strings.Index(script, "redirect to :22340") > strings.Index(script, `iifname "torbr-1" drop`) {
+		t.Errorf("expected the redirects to come first in script:\n%s", script)
+	}
+}
+
+func TestIptablesProgramScript(t *testing.T) {
+	rules := []firewallRule{
+		{table: "nat", chain: "PREROUTING", in: "torbr-1", proto: "tcp", syn: true, target: "REDIRECT", toPort: "22340"},
+		{table: "filter", chain: "INPUT", in: "torbr-1", target: "DROP"},
+	}
+	jumps := iptablesJumps("torbr-1")[2:3]
+
+	// the rules are tagged for check to find them again
+	expected := fmt.Sprintf(`*filter
+:TOR-FWD-torbr-1 - [0:0]
+:TOR-IN-torbr-1 - [0:0]
+-A TOR-IN-torbr-1 -i torbr-1 -m comment --comment %s -j DROP
+-I INPUT -i torbr-1 -j TOR-IN-torbr-1
+COMMIT
+*nat
+:TOR-PRE-torbr-1 - [0:0]
+:TOR-POST-torbr-1 - [0:0]
+-A TOR-PRE-torbr-1 -i torbr-1 -p tcp --syn -m comment --comment %s -j REDIRECT --to-ports 22340
+COMMIT
+`, ruleTag("-i torbr-1 -j DROP"), ruleTag("-i torbr-1 -p tcp --syn -j REDIRECT --to-ports 22340"))
+	if script := iptablesProgramScript("torbr-1", rules, jumps); script != expected {
+		t.Fatalf("expected script:\n%s\ngot:\n%s", expected, script)
+	}
+
+	expected = `*filter
+-D INPUT -i torbr-1 -j TOR-IN-torbr-1
+:TOR-FWD-torbr-1 - [0:0]
+-X TOR-FWD-torbr-1
+:TOR-IN-torbr-1 - [0:0]
+-X TOR-IN-torbr-1
+COMMIT
+*nat
+:TOR-PRE-torbr-1 - [0:0]
+-X TOR-PRE-torbr-1
+:TOR-POST-torbr-1 - [0:0]
+-X TOR-POST-torbr-1
+COMMIT
+`
+	if script := iptablesRemoveScript("torbr-1", jumps); script != expected {
+		t.Fatalf("expected script:\n%s\ngot:\n%s", expected, script)
+	}
+}
+
+func TestIptablesRuleOrder(t *testing.T) {
+	accept := firewallRule{table: "filter", chain: "FORWARD", in: "torbr-1", out: "!torbr-1", target: "ACCEPT"}
+	drop := firewallRule{table: "filter", chain: "FORWARD", in: "torbr-1", proto: "udp", comment: "onion-drop", target: "DROP"}
+	expected := []firewallRule{drop, accept}
+	tag := func(r firewallRule) (string, error) {
+		return ruleTag(strings.Join(r.iptablesArgs(), " ")), nil
+	}
+	line := func(r firewallRule) string {
+		return "-A TOR-FWD-torbr-1 " + iptablesScriptArgs(r.iptablesTagged())
+	}
+
+	for _, tc := range []struct {
+		name     string
+		output   string
+		drifted  int
+		comments int
+	}{
+		{"in order", "-N TOR-FWD-torbr-1\n" + line(drop) + "\n" + line(accept) + "\n", 0, 2},
+		// the accept ahead of the drop lets the udp through
+		{"reordered", "-N TOR-FWD-torbr-1\n" + line(accept) + "\n" + line(drop) + "\n", 2, 2},
+		{"missing", "-N TOR-FWD-torbr-1\n" + line(accept) + "\n", 1, 1},
+		{"added", "-N TOR-FWD-torbr-1\n-A TOR-FWD-torbr-1 -j ACCEPT\n" + line(drop) + "\n" + line(accept) + "\n", 2, 3},
+	} {
+		comments := iptablesRuleComments(tc.output)
+		if len(comments) != tc.comments {
+			t.Errorf("%s: expected %d rules, got %v", tc.name, tc.comments, comments)
+		}
+		drifted, err := driftedRules(expected, comments, tag)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(drifted) != tc.drifted {
+			t.Errorf("%s: expected %d drifted rules, got %v", tc.name, tc.drifted, drifted)
+		}
+	}
+
+	// the comment of the rule is kept apart from its tag for the counters
+	counters := iptablesCounters(`-A TOR-FWD-torbr-1 -i torbr-1 -p udp -m comment --comment "onion-drop onion:0123456789ab" -c 5 300 -j DROP` + "\n")
+	if len(counters) != 1 || counters["onion-drop"] != 5 {
+		t.Errorf("expected 5 packets for onion-drop, got %v", counters)
+	}
+}
+
+func TestNftRuleComments(t *testing.T) {
+	redirect := firewallRule{table: "nat", chain: "PREROUTING", in: "torbr-1", proto: "tcp", syn: true, target: "REDIRECT", toPort: "22340"}
+	drop := firewallRule{table: "filter", chain: "INPUT", in: "torbr-1", comment: "onion-drop", target: "DROP"}
+	tagged, err := drop.nftTagged()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expr, _ := drop.nftExpr()
+	if !strings.HasSuffix(tagged, fmt.Sprintf(`comment "onion-drop %s"`, ruleTag(expr))) {
+		t.Fatalf("expected the tag in the comment of %q", tagged)
+	}
+	redirectExpr, _ := redirect.nftExpr()
+	redirectTag := ruleTag(redirectExpr)
+
+	// nft lists the rules in its own form, the tags are kept as they are
+	output := fmt.Sprintf(`table ip onion_torbr_1 {
+	chain prerouting {
+		type nat hook prerouting priority dstnat; policy accept;
+		iifname "torbr-1" tcp flags syn / fin,syn,rst,ack redirect to :22340 comment "%s"
+		iifname "torbr-1" accept
+	}
+
+	chain input {
+		type filter hook input priority filter; policy accept;
+		iifname "torbr-1" counter packets 4 bytes 240 drop comment "onion-drop %s"
+	}
+
+	chain forward {
+		type filter hook forward priority filter; policy accept;
+	}
+}
+`, redirectTag, ruleTag(expr))
+
+	comments := nftRuleComments(output)
+	prerouting := []string{"", ""}
+	for i, c := range comments["prerouting"] {
+		_, prerouting[i] = splitRuleComment(c)
+	}
+	if len(comments["prerouting"]) != 2 || !equalStrings(prerouting, []string{redirectTag, ""}) {
+		t.Errorf("expected the redirect and an untagged rule in prerouting, got %v", comments["prerouting"])
+	}
+	if !equalStrings(comments["input"], []string{"onion-drop " + ruleTag(expr)}) {
+		t.Errorf("expected the drop in input, got %v", comments["input"])
+	}
+	if len(comments["forward"]) != 0 {
+		t.Errorf("expected no rules in forward, got %v", comments["forward"])
+	}
+
+	if counters := nftCounters(output); len(counters) != 1 || counters["onion-drop"] != 4 {
+		t.Errorf("expected 4 packets for onion-drop, got %v", counters)
+	}
+
+	// a rule that changed gets another tag
+	drop.target = "ACCEPT"
+	if changed, _ := drop.nftExpr(); ruleTag(changed) == ruleTag(expr) {
+		t.Errorf("expected a changed rule to get another tag")
+	}
+}
+
+func TestIptablesPolicy(t *testing.T) {
+	output := `-P FORWARD DROP
+-A FORWARD -j DOCKER-USER
+`
+	if policy := iptablesPolicy(output, "FORWARD"); policy != "DROP" {
+		t.Errorf("expected policy DROP, got %q", policy)
+	}
+	if policy := iptablesPolicy(output, "INPUT"); policy != "" {
+		t.Errorf("expected no INPUT policy, got %q", policy)
+	}
+}
+
+func TestShadowingRules(t *testing.T) {
+	output := `-P FORWARD DROP
+-A FORWARD -j DOCKER-USER
+-A FORWARD -i docker0 -j ACCEPT
+-A FORWARD ! -i docker0 -o torbr-1 -j ACCEPT
+-A FORWARD -i veth+ -j ACCEPT
+-A FORWARD -o torbr-1 -j TOR-FWD-torbr-1
+-A FORWARD -i torbr-1 -j ACCEPT
+-A FORWARD -j ACCEPT
+`
+	jump := firewallRule{table: "filter", chain: "FORWARD", out: "torbr-1", target: "TOR-FWD-torbr-1"}
+	expected := []string{
+		"-A FORWARD -i docker0 -j ACCEPT",
+		"-A FORWARD ! -i docker0 -o torbr-1 -j ACCEPT",
+		"-A FORWARD -i veth+ -j ACCEPT",
+	}
+	rules := shadowingRules(output, jump)
+	if strings.Join(rules, "\n") != strings.Join(expected, "\n") {
+		t.Fatalf("expected rules:\n%s\ngot:\n%s", strings.Join(expected, "\n"), strings.Join(rules, "\n"))
+	}
+
+	jump = firewallRule{table: "filter", chain: "FORWARD", in: "torbr-1", target: "TOR-FWD-torbr-1"}
+	expected = []string{
+		"-A FORWARD ! -i docker0 -o torbr-1 -j ACCEPT",
+		"-A FORWARD -i torbr-1 -j ACCEPT",
+		"-A FORWARD -j ACCEPT",
+	}
+	rules = shadowingRules(output, jump)
+	if strings.Join(rules, "\n") != strings.Join(expected, "\n") {
+		t.Fatalf("expected rules:\n%s\ngot:\n%s", strings.Join(expected, "\n"), strings.Join(rules, "\n"))
+	}
+}
@@ -0,0 +1,183 @@
+package tor
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/sirupsen/logrus"
+	"github.com/vishvananda/netlink"
+)
+
+// host is what the driver changes on the host besides the firewall: links,
+// addresses, sysctls, conntrack and the network namespaces of the
+// containers.
+type host interface {
+	// enableIPForwarding turns on ipv4 forwarding.
+	enableIPForwarding() error
+	// linkExists reports whether there is a link with the name.
+	linkExists(name string) (bool, error)
+	// addBridge creates the bridge with the address, disables ipv6 on it
+	// and brings it up.
+	addBridge(name string, mtu int, addr string) error
+	// addVeth creates the veth pair with one end in the bridge and brings
+	// it up.
+	addVeth(name, peer, bridge string) error
+	// deleteLink deletes the link with the name.
+	deleteLink(name string) error
+	// setLinkDown takes the link with the name down.
+	setLinkDown(name string) error
+	// setLinkUp brings the link with the name up.
+	setLinkUp(name string) error
+	// ifaceAddr returns the ipv4 address of the link with the name.
+	ifaceAddr(name string) (*net.IPNet, error)
+	// flushConntrack deletes the flows from the subnet that go around tor.
+	flushConntrack(subnet *net.IPNet) error
+	// setupSandboxFirewall programs the chain of an endpoint in the
+	// network namespace at sandboxKey.
+	setupSandboxFirewall(sandboxKey string, rules sandboxRules) error
+	// removeSandboxFirewall deletes the chain of an endpoint from the
+	// network namespace at sandboxKey.
+	removeSandboxFirewall(sandboxKey string, rules sandboxRules) error
+	// listenAddr returns where to listen to serve the service on addr.
+	listenAddr(service, addr string) string
+}
+
+// systemHost makes the changes to the host.
+type systemHost struct{}
+
+func (systemHost) enableIPForwarding() error {
+	return setupIPForwarding()
+}
+
+func (systemHost) linkExists(name string) (bool, error) {
+	_, err := netlink.LinkByName(name)
+	if err == nil {
+		return true, nil
+	}
+	if _, ok := err.(netlink.LinkNotFoundError); ok {
+		return false, nil
+	}
+	return false, err
+}
+
+func (systemHost) addBridge(name string, mtu int, addr string) error {
+	// create *netlink.Bridge object
+	la := netlink.NewLinkAttrs()
+	la.Name = name
+	la.MTU = mtu
+	br := &netlink.Bridge{LinkAttrs: la}
+	if err := netlink.LinkAdd(br); err != nil {
+		return fmt.Errorf("Bridge creation failed for bridge %s: %v", name, err)
+	}
+
+	// Set bridge IP
+	if err := setInterfaceIP(name, addr); err != nil {
+		return fmt.Errorf("Error assigning address: %s on bridge: %s with an error of: %v", addr, name, err)
+	}
+
+	// Validate that the IPAddress is there!
+	if _, err := getIfaceAddr(name); err != nil {
+		return fmt.Errorf("No IP address found on bridge %s: %v", name, err)
+	}
+
+	// Tor does not route ipv6
+	if err := disableIPv6(name); err != nil {
+		return err
+	}
+
+	// Bring the bridge up
+	if err := interfaceUp(name); err != nil {
+		return fmt.Errorf("Error enabling bridge for %s: %v", name, err)
+	}
+
+	return nil
+}
+
+func (systemHost) addVeth(name, peer, bridge string) error {
+	br, err := netlink.LinkByName(bridge)
+	if err != nil {
+		return err
+	}
+
+	la := netlink.NewLinkAttrs()
+	la.Name = name
+	la.MasterIndex = br.Attrs().Index
+	veth := &netlink.Veth{
+		LinkAttrs: la,
+		PeerName:  peer,
+	}
+
+	if err := netlink.LinkAdd(veth); err != nil {
+		return fmt.Errorf("failed to create the veth pair named: [ %v ] error: [ %s ] ", veth, err)
+	}
+
+	// Bring the veth pair up
+	if err := netlink.LinkSetUp(veth); err != nil {
+		return fmt.Errorf("Error enabling Veth local iface: [ %v ]: %v", veth, err)
+	}
+	return nil
+}
+
+func (systemHost) deleteLink(name string) error {
+	l, err := netlink.LinkByName(name)
+	if err != nil {
+		return fmt.Errorf("Getting link with name %s failed: %v", name, err)
+	}
+	return netlink.LinkDel(l)
+}
+
+func (systemHost) setLinkDown(name string) error {
+	l, err := netlink.LinkByName(name)
+	if err != nil {
+		return err
+	}
+	return netlink.LinkSetDown(l)
+}
+
+func (systemHost) setLinkUp(name string) error {
+	l, err := netlink.LinkByName(name)
+	if err != nil {
+		return err
+	}
+	return netlink.LinkSetUp(l)
+}
+
+func (systemHost) ifaceAddr(name string) (*net.IPNet, error) {
+	return getIfaceAddr(name)
+}
+
+func (systemHost) flushConntrack(subnet *net.IPNet) error {
+	return flushConntrack(subnet)
+}
+
+func (systemHost) setupSandboxFirewall(sandboxKey string, rules sandboxRules) error {
+	return inSandbox(sandboxKey, func() error {
+		if err := sandboxRestore("iptables", rules.chain, rules.src, rules.script); err != nil {
+			return err
+		}
+		if rules.src6 == "" {
+			return nil
+		}
+		if err := sandboxRestore("ip6tables", rules.chain, rules.src6, rules.script6); err != nil {
+			// the kernel might not do ipv6 at all
+			logrus.Warnf("Setting up the ipv6 firewall in sandbox %s failed: %v", sandboxKey, err)
+		}
+		return nil
+	})
+}
+
+func (systemHost) removeSandboxFirewall(sandboxKey string, rules sandboxRules) error {
+	return inSandbox(sandboxKey, func() error {
+		if err := sandboxRemove("iptables", rules.chain, rules.src); err != nil {
+			return err
+		}
+		if rules.src6 == "" {
+			return nil
+		}
+		return sandboxRemove("ip6tables", rules.chain, rules.src6)
+	})
+}
+
+func (systemHost) listenAddr(service, addr string) string {
+	return addr
+}
@@ -0,0 +1,83 @@
+package tor
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// portSpec is a single port and protocol pair.
+type portSpec struct {
+	port  string
+	proto string
+}
+
+func (p portSpec) String() string {
+	return p.port + "/" + p.proto
+}
+
+// parsePorts parses a comma separated list of ports in the form
+// port[/proto], for example "5000,8125/udp". The protocol defaults to tcp.
+func parsePorts(v string) ([]portSpec, error) {
+	var ports []portSpec
+	for _, entry := range strings.Split(v, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		p := portSpec{port: entry, proto: "tcp"}
+		if i := strings.Index(entry, "/"); i != -1 {
+			p.port, p.proto = entry[:i], strings.ToLower(entry[i+1:])
+		}
+		if p.proto != "tcp" && p.proto != "udp" {
+			return nil, fmt.Errorf("unsupported protocol %q in %q", p.proto, entry)
+		}
+		if n, err := strconv.Atoi(p.port); err != nil || n < 1 || n > 65535 {
+			return nil, fmt.Errorf("invalid port %q", entry)
+		}
+		ports = append(ports, p)
+	}
+	return ports, nil
+}
+
+// getHostAllowedPorts parses the option listing the ports on the host, besides
+// the tor ports, that containers on the network may connect to.
+func getHostAllowedPorts(opts map[string]interface{}) ([]portSpec, error) {
+	v, ok := getOption(opts, hostAllowOption)
+	if !ok {
+		return nil, nil
+	}
+	ports, err := parsePorts(v)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid %s: %v", hostAllowOption, err)
+	}
+	return ports, nil
+}
+
+// restrictHostAccess only lets containers on the bridge reach the tor ports
+// and the explicitly allowed ports on the host, everything else coming in
+// from the bridge is dropped. This keeps a compromised container from using
+// the gateway address to get at services listening on the host.
+func (fc *firewallConfig) restrictHostAccess() []firewallRule {
+	rules := []firewallRule{
+		{table: "filter", chain: "INPUT", in: fc.bridgeName,
+			ctstate: []string{"RELATED", "ESTABLISHED"}, target: "ACCEPT"},
+		{table: "filter", chain: "INPUT", in: fc.bridgeName,
+			proto: "tcp", dport: fc.transPort, target: "ACCEPT"},
+		{table: "filter", chain: "INPUT", in: fc.bridgeName,
+			proto: "udp", dport: fc.dnsPort, target: "ACCEPT"},
+		{table: "filter", chain: "INPUT", in: fc.bridgeName,
+			proto: "tcp", dport: dnsProxyPort, target: "ACCEPT"},
+	}
+	if fc.i2pNet != "" && fc.transPort != proxyPort {
+		// the .i2p names go to the transparent proxy in any case
+		rules = append(rules, firewallRule{table: "filter", chain: "INPUT", in: fc.bridgeName,
+			proto: "tcp", dport: proxyPort, target: "ACCEPT"})
+	}
+	for _, p := range fc.hostAllow {
+		rules = append(rules, firewallRule{table: "filter", chain: "INPUT", in: fc.bridgeName,
+			proto: p.proto, dport: p.port, target: "ACCEPT"})
+	}
+	return append(rules, firewallRule{table: "filter", chain: "INPUT", in: fc.bridgeName, target: "DROP"})
+}
@@ -0,0 +1,25 @@
+package tor
+
+import "testing"
+
+func TestParsePorts(t *testing.T) {
+	ports, err := parsePorts("5000, 8125/udp,443/TCP")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"5000/tcp", "8125/udp", "443/tcp"}
+	if len(ports) != len(expected) {
+		t.Fatalf("expected %d ports, got %d", len(expected), len(ports))
+	}
+	for i, p := range ports {
+		if p.String() != expected[i] {
+			t.Errorf("expected port %d to be %s, got %s", i, expected[i], p)
+		}
+	}
+
+	for _, v := range []string{"0", "65536", "http", "53/icmp"} {
+		if _, err := parsePorts(v); err == nil {
+			t.Errorf("expected error parsing %q", v)
+		}
+	}
+}
@@ -0,0 +1,170 @@
+package tor
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+const (
+	// hostnamePeekTimeout is how long to wait for the client to send the
+	// start of a TLS or HTTP request, protocols where the server speaks
+	// first get no hostname once it passed.
+	hostnamePeekTimeout = 5 * time.Second
+	// hostnamePeekSize is how much of the start of a connection is read
+	// looking for the hostname, the largest TLS record and its header.
+	hostnamePeekSize = 5 + 1<<14
+
+	tlsRecordHandshake    = 0x16
+	tlsClientHello        = 1
+	tlsExtensionSNI       = 0
+	tlsSNIHostName        = 0
+	tlsRecordHeaderLength = 5
+)
+
+// peekHostname reads the start of the connection to find the hostname the
+// client is after, in the server name of a TLS ClientHello or the Host
+// header of an HTTP request. It returns the hostname, empty if there is
+// none, and what it read, which has to be sent on before the rest of the
+// connection.
+func peekHostname(conn net.Conn) (string, []byte) {
+	conn.SetReadDeadline(time.Now().Add(hostnamePeekTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	b := make([]byte, 0, hostnamePeekSize)
+	for len(b) < cap(b) {
+		n, err := conn.Read(b[len(b):cap(b)])
+		b = b[:len(b)+n]
+
+		switch {
+		case len(b) == 0:
+		case b[0] == tlsRecordHandshake:
+			if len(b) < tlsRecordHeaderLength {
+				break
+			}
+			end := tlsRecordHeaderLength + int(binary.BigEndian.Uint16(b[3:5]))
+			if len(b) >= end {
+				return clientHelloServerName(b[tlsRecordHeaderLength:end]), b
+			}
+		case b[0] >= 'A' && b[0] <= 'Z':
+			if i := bytes.Index(b, []byte("\r\n\r\n")); i >= 0 {
+				return httpHost(b[:i]), b
+			}
+		default:
+			// neither TLS nor HTTP
+			return "", b
+		}
+
+		if err != nil {
+			return "", b
+		}
+	}
+	return "", b
+}
+
+// clientHelloServerName returns the server name of the TLS handshake
+// message if it is a ClientHello, or an empty string.
+func clientHelloServerName(b []byte) string {
+	// handshake type, length, client version and random
+	if len(b) < 38 || b[0] != tlsClientHello {
+		return ""
+	}
+	b = b[38:]
+
+	// session id, cipher suites and compression methods
+	for _, lenBytes := range []int{1, 2, 1} {
+		if len(b) < lenBytes {
+			return ""
+		}
+		l := int(b[0])
+		if lenBytes == 2 {
+			l = int(binary.BigEndian.Uint16(b))
+		}
+		if len(b) < lenBytes+l {
+			return ""
+		}
+		b = b[lenBytes+l:]
+	}
+
+	if len(b) < 2 {
+		return ""
+	}
+	exts := b[2:]
+	if l := int(binary.BigEndian.Uint16(b)); l < len(exts) {
+		exts = exts[:l]
+	}
+	for len(exts) >= 4 {
+		typ := binary.BigEndian.Uint16(exts)
+		l := int(binary.BigEndian.Uint16(exts[2:]))
+		if len(exts) < 4+l {
+			return ""
+		}
+		data := exts[4 : 4+l]
+		exts = exts[4+l:]
+		if typ != tlsExtensionSNI || len(data) < 2 {
+			continue
+		}
+
+		names := data[2:]
+		for len(names) >= 3 {
+			nl := int(binary.BigEndian.Uint16(names[1:]))
+			if len(names) < 3+nl {
+				return ""
+			}
+			if names[0] == tlsSNIHostName {
+				return normalizeHostname(string(names[3 : 3+nl]))
+			}
+			names = names[3+nl:]
+		}
+	}
+	return ""
+}
+
+// httpHost returns the host of the Host header of the HTTP request head,
+// or an empty string.
+func httpHost(head []byte) string {
+	lines := strings.Split(string(head), "\r\n")
+	for _, line := range lines[1:] {
+		i := strings.IndexByte(line, ':')
+		if i < 0 || !strings.EqualFold(strings.TrimSpace(line[:i]), "host") {
+			continue
+		}
+		host := strings.TrimSpace(line[i+1:])
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		return normalizeHostname(host)
+	}
+	return ""
+}
+
+func normalizeHostname(host string) string {
+	return strings.TrimSuffix(strings.ToLower(host), ".")
+}
+
+// peekedConn is a connection of which the start was already read.
+type peekedConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func newPeekedConn(conn net.Conn, peeked []byte) *peekedConn {
+	return &peekedConn{Conn: conn, r: io.MultiReader(bytes.NewReader(peeked), conn)}
+}
+
+func (c *peekedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// CloseWrite half-closes the connection if it can be.
+func (c *peekedConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface {
+		CloseWrite() error
+	}); ok {
+		return cw.CloseWrite()
+	}
+	return c.Conn.Close()
+}
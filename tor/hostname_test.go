@@ -0,0 +1,106 @@
+package tor
+
+import (
+	"crypto/tls"
+	"io/ioutil"
+	"net"
+	"testing"
+)
+
+// clientStart returns the connection the proxy reads from, on which the
+// client starts with start.
+func clientStart(t *testing.T, start func(net.Conn)) net.Conn {
+	client, conn := net.Pipe()
+	go func() {
+		start(client)
+		client.Close()
+	}()
+	return conn
+}
+
+func TestPeekHostnameTLS(t *testing.T) {
+	conn := clientStart(t, func(c net.Conn) {
+		// the handshake fails once the proxy side closes
+		tls.Client(c, &tls.Config{ServerName: "Check.TorProject.org"}).Handshake()
+	})
+	defer conn.Close()
+
+	hostname, peeked := peekHostname(conn)
+	if hostname != "check.torproject.org" {
+		t.Fatalf("expected the server name check.torproject.org, got %q", hostname)
+	}
+	if len(peeked) == 0 || peeked[0] != tlsRecordHandshake {
+		t.Fatalf("expected the ClientHello to be kept, got %d bytes", len(peeked))
+	}
+}
+
+func TestPeekHostnameHTTP(t *testing.T) {
+	request := "GET / HTTP/1.1\r\nUser-Agent: curl\r\nhost: Example.com:8080\r\n\r\n"
+	conn := clientStart(t, func(c net.Conn) {
+		c.Write([]byte(request))
+		c.Write([]byte("body"))
+	})
+	defer conn.Close()
+
+	hostname, peeked := peekHostname(conn)
+	if hostname != "example.com" {
+		t.Fatalf("expected the host example.com, got %q", hostname)
+	}
+
+	// the request is relayed as it was sent
+	b, err := ioutil.ReadAll(newPeekedConn(conn, peeked))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != request+"body" {
+		t.Fatalf("expected the whole request to be relayed, got %q", b)
+	}
+}
+
+func TestPeekHostnameOther(t *testing.T) {
+	conn := clientStart(t, func(c net.Conn) {
+		c.Write([]byte("\x00\x01binary"))
+	})
+	defer conn.Close()
+
+	if hostname, peeked := peekHostname(conn); hostname != "" || len(peeked) == 0 {
+		t.Fatalf("expected no hostname and what was read, got %q and %q", hostname, peeked)
+	}
+}
+
+func TestCheckHostname(t *testing.T) {
+	p := &transparentProxy{hosts: &domainPolicy{networkID: "net3", hits: hostPolicyHits, allow: &domainList{
+		set: &domainSet{exact: map[string]bool{}, suffixes: []string{".torproject.org"}},
+	}}}
+
+	for request, expected := range map[string]bool{
+		"GET / HTTP/1.1\r\nHost: www.torproject.org\r\n\r\n": true,
+		"GET / HTTP/1.1\r\nHost: example.com\r\n\r\n":        false,
+		"\x00\x01binary": false,
+	} {
+		request := request
+		conn := clientStart(t, func(c net.Conn) {
+			c.Write([]byte(request))
+		})
+		if _, _, allowed := p.checkHostname(conn); allowed != expected {
+			t.Errorf("%q: expected allowed to be %v, got %v", request, expected, allowed)
+		}
+		conn.Close()
+	}
+}
+
+func TestHostTarget(t *testing.T) {
+	dst := &net.TCPAddr{IP: net.IPv4(151, 101, 1, 1), Port: 443}
+	for _, tc := range []struct {
+		target, hostname, expected string
+	}{
+		// the allowed hostname is dialed, not the front at the address
+		{"151.101.1.1:443", "www.torproject.org", "www.torproject.org:443"},
+		{"151.101.1.1:443", "", "151.101.1.1:443"},
+		{"example.i2p:443", "www.torproject.org", "example.i2p:443"},
+	} {
+		if target := hostTarget(dst, tc.target, tc.hostname); target != tc.expected {
+			t.Errorf("%s for %q: expected %s, got %s", tc.target, tc.hostname, tc.expected, target)
+		}
+	}
+}
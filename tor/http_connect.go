@@ -0,0 +1,74 @@
+package tor
+
+import (
+	"bufio"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+// httpConnectDialer connects through an HTTP proxy with the CONNECT
+// method, authenticating with basic auth if it has credentials.
+type httpConnectDialer struct {
+	addr    string
+	auth    *proxy.Auth
+	forward proxy.Dialer
+	// timeout bounds the CONNECT exchange, so a proxy that never answers
+	// does not hold on to the connection
+	timeout time.Duration
+}
+
+// Dial connects to the address through the proxy.
+func (d *httpConnectDialer) Dial(network, addr string) (net.Conn, error) {
+	conn, err := d.forward.Dial("tcp", d.addr)
+	if err != nil {
+		return nil, err
+	}
+
+	if d.timeout > 0 {
+		conn.SetDeadline(time.Now().Add(d.timeout))
+	}
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: http.Header{},
+	}
+	if d.auth != nil {
+		credentials := base64.StdEncoding.EncodeToString([]byte(d.auth.User + ":" + d.auth.Password))
+		req.Header.Set("Proxy-Authorization", "Basic "+credentials)
+	}
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("proxy %s refused to connect to %s: %s", d.addr, addr, resp.Status)
+	}
+	// the connection is relayed from here on
+	if err := conn.SetDeadline(time.Time{}); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	// the destination might have spoken already
+	if n := br.Buffered(); n > 0 {
+		b, _ := br.Peek(n)
+		return newPeekedConn(conn, b), nil
+	}
+	return conn, nil
+}
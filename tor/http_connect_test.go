@@ -0,0 +1,200 @@
+package tor
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/docker/libnetwork/netlabel"
+)
+
+// fakeHTTPConnect is an HTTP proxy only doing CONNECT for the clients
+// with the credentials, remembering the targets.
+type fakeHTTPConnect struct {
+	listener      net.Listener
+	authorization string
+	sync.Mutex
+	targets []string
+}
+
+func newFakeHTTPConnect(t *testing.T, user, password string) *fakeHTTPConnect {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, _ := http.NewRequest(http.MethodConnect, "http://example.com", nil)
+	req.SetBasicAuth(user, password)
+	p := &fakeHTTPConnect{listener: l, authorization: req.Header.Get("Authorization")}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go p.handle(conn)
+		}
+	}()
+	return p
+}
+
+func (p *fakeHTTPConnect) handle(conn net.Conn) {
+	defer conn.Close()
+
+	req, err := http.ReadRequest(bufio.NewReader(conn))
+	if err != nil {
+		return
+	}
+	if req.Method != http.MethodConnect {
+		io.WriteString(conn, "HTTP/1.1 405 Method Not Allowed\r\n\r\n")
+		return
+	}
+	if req.Header.Get("Proxy-Authorization") != p.authorization {
+		io.WriteString(conn, "HTTP/1.1 407 Proxy Authentication Required\r\n\r\n")
+		return
+	}
+
+	p.Lock()
+	p.targets = append(p.targets, req.Host)
+	p.Unlock()
+
+	upstream, err := net.Dial("tcp", req.Host)
+	if err != nil {
+		io.WriteString(conn, "HTTP/1.1 502 Bad Gateway\r\n\r\n")
+		return
+	}
+	defer upstream.Close()
+	io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+
+	relay(conn, upstream)
+}
+
+// ping sends ping through the proxy to the echo server and checks that it
+// comes back.
+func ping(t *testing.T, p *transparentProxy, dst string) error {
+	client, conn := net.Pipe()
+	defer client.Close()
+	errc := make(chan error, 1)
+	go func() {
+		_, _, err := p.forward(conn, dst, "endpoint:fedcba9876543210", 0)
+		conn.Close()
+		errc <- err
+	}()
+
+	go client.Write([]byte("ping"))
+	b := make([]byte, 4)
+	if _, err := io.ReadFull(client, b); err != nil {
+		return <-errc
+	}
+	if string(b) != "ping" {
+		t.Fatalf("expected ping back, got %q", b)
+	}
+	return nil
+}
+
+func TestTransparentProxyHTTPConnect(t *testing.T) {
+	httpProxy := newFakeHTTPConnect(t, "alice", "s3cret")
+	defer httpProxy.listener.Close()
+	echo := echoServer(t)
+	defer echo.Close()
+
+	upstream, err := getUpstream(map[string]interface{}{netlabel.GenericData: map[string]string{
+		upstreamOption: "http://alice:s3cret@" + httpProxy.listener.Addr().String(),
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ping(t, &transparentProxy{upstream: upstream}, echo.Addr().String()); err != nil {
+		t.Fatal(err)
+	}
+
+	httpProxy.Lock()
+	if len(httpProxy.targets) != 1 || httpProxy.targets[0] != echo.Addr().String() {
+		t.Fatalf("expected the proxy to connect to %s, got %v", echo.Addr(), httpProxy.targets)
+	}
+	httpProxy.Unlock()
+
+	// wrong credentials are refused
+	upstream.User = nil
+	if err := ping(t, &transparentProxy{upstream: upstream}, echo.Addr().String()); err == nil {
+		t.Fatal("expected the proxy to refuse the connection without credentials")
+	}
+}
+
+func TestHTTPConnectSilentUpstream(t *testing.T) {
+	// a proxy that accepts the connection and never answers
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	d := &httpConnectDialer{addr: l.Addr().String(), forward: &net.Dialer{}, timeout: 100 * time.Millisecond}
+	errc := make(chan error, 1)
+	go func() {
+		conn, err := d.Dial("tcp", "example.com:80")
+		if conn != nil {
+			conn.Close()
+		}
+		errc <- err
+	}()
+
+	select {
+	case err := <-errc:
+		if nerr, ok := err.(net.Error); !ok || !nerr.Timeout() {
+			t.Fatalf("expected a timeout, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the CONNECT exchange to time out")
+	}
+}
+
+func TestTransparentProxySOCKS5Upstream(t *testing.T) {
+	socks := newFakeSOCKS5(t)
+	defer socks.listener.Close()
+	echo := echoServer(t)
+	defer echo.Close()
+
+	upstream, err := getUpstream(map[string]interface{}{netlabel.GenericData: map[string]string{
+		upstreamOption: "socks5://" + socks.listener.Addr().String(),
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a proxy other than tor gets no isolation credentials
+	if err := ping(t, &transparentProxy{upstream: upstream, networkID: "0123456789abcdef"}, echo.Addr().String()); err != nil {
+		t.Fatal(err)
+	}
+
+	socks.Lock()
+	defer socks.Unlock()
+	if len(socks.users) != 1 || socks.users[0] != "" {
+		t.Fatalf("expected no credentials, got %q", socks.users)
+	}
+}
+
+func TestGetUpstream(t *testing.T) {
+	for _, v := range []string{"", "tor"} {
+		u, err := getUpstream(map[string]interface{}{netlabel.GenericData: map[string]string{upstreamOption: v}})
+		if err != nil || u != nil {
+			t.Fatalf("%q: expected the tor upstream, got %v, %v", v, u, err)
+		}
+	}
+	for _, v := range []string{"ftp://proxy:21", "http://", "proxy:3128"} {
+		if _, err := getUpstream(map[string]interface{}{netlabel.GenericData: map[string]string{upstreamOption: v}}); err == nil {
+			t.Errorf("expected error for %q", v)
+		}
+	}
+}
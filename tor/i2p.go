@@ -0,0 +1,216 @@
+package tor
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// i2pMixed sends the .i2p destinations of a network to I2P and
+	// everything else to tor.
+	i2pMixed = "true"
+	// i2pOnly only lets the containers of a network reach .i2p
+	// destinations.
+	i2pOnly = "only"
+
+	// defaultI2PVirtualAddrNetwork is the range the .i2p names are mapped
+	// into, next to tor's default VirtualAddrNetworkIPv4.
+	defaultI2PVirtualAddrNetwork = "10.128.0.0/10"
+)
+
+// getI2P parses the i2p options of a network, returning the mode, empty if
+// the network does not reach I2P, and the range the .i2p names are mapped
+// into.
+func getI2P(opts map[string]interface{}) (string, *net.IPNet, error) {
+	v, ok := getOption(opts, i2pOption)
+	if !ok || v == "" {
+		return "", nil, nil
+	}
+	mode := v
+	if v != i2pOnly {
+		enabled, err := strconv.ParseBool(v)
+		if err != nil {
+			return "", nil, fmt.Errorf("Invalid %s %q, must be a boolean or %s", i2pOption, v, i2pOnly)
+		}
+		if !enabled {
+			return "", nil, nil
+		}
+		mode = i2pMixed
+	}
+
+	cidr := defaultI2PVirtualAddrNetwork
+	if v, ok := getOption(opts, i2pVirtualAddrNetworkOption); ok && v != "" {
+		cidr = v
+	}
+	_, virtualNet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return "", nil, fmt.Errorf("Invalid %s %q: %v", i2pVirtualAddrNetworkOption, cidr, err)
+	}
+	if virtualNet.IP.To4() == nil {
+		return "", nil, ErrUnsupportedAddressType(cidr)
+	}
+
+	return mode, virtualNet, nil
+}
+
+// isI2PName returns whether the name is a .i2p name.
+func isI2PName(name string) bool {
+	name = strings.TrimSuffix(strings.ToLower(name), ".")
+	return strings.HasSuffix(name, ".i2p")
+}
+
+// i2pAddrMap maps the .i2p names the containers resolve to addresses of
+// a virtual range, for the transparent proxy to know which name the
+// connections to those addresses are for. There are at most
+// i2pAddrMapSize mappings, the addresses of the ones not used for
+// i2pAddrIdleTimeout are handed out again once they are all taken.
+type i2pAddrMap struct {
+	virtualNet *net.IPNet
+
+	sync.Mutex
+	next   uint32
+	free   []net.IP
+	byName map[string]*i2pAddr
+	byAddr map[string]*i2pAddr
+}
+
+// i2pAddr is the mapping of a .i2p name to its address.
+type i2pAddr struct {
+	name string
+	ip   net.IP
+	used time.Time // when it was last resolved or connected to
+}
+
+const (
+	i2pAddrMapSize = 4096
+	// i2pAddrIdleTimeout is well over the ttl of the answers, so a
+	// container does not connect to an address that went to another name
+	i2pAddrIdleTimeout = 10 * time.Minute
+)
+
+func newI2PAddrMap(virtualNet *net.IPNet) *i2pAddrMap {
+	return &i2pAddrMap{
+		virtualNet: virtualNet,
+		byName:     map[string]*i2pAddr{},
+		byAddr:     map[string]*i2pAddr{},
+	}
+}
+
+// addr returns the address of the name, mapping it to a free one of the
+// range the first time. It returns nil once the range is used up.
+func (m *i2pAddrMap) addr(name string) net.IP {
+	m.Lock()
+	defer m.Unlock()
+
+	if a, ok := m.byName[name]; ok {
+		a.used = time.Now()
+		return a.ip
+	}
+
+	ip := m.allocate()
+	if ip == nil {
+		return nil
+	}
+	a := &i2pAddr{name: name, ip: ip, used: time.Now()}
+	m.byName[name] = a
+	m.byAddr[ip.String()] = a
+	return ip
+}
+
+// allocate returns a free address of the range, or nil if there is none.
+// The caller holds the lock.
+func (m *i2pAddrMap) allocate() net.IP {
+	if len(m.free) == 0 {
+		ones, bits := m.virtualNet.Mask.Size()
+		size := uint32(1) << uint(bits-ones)
+		// skip the network and the broadcast address
+		if m.next+2 < size && m.next < i2pAddrMapSize {
+			m.next++
+			ip := make(net.IP, net.IPv4len)
+			binary.BigEndian.PutUint32(ip, binary.BigEndian.Uint32(m.virtualNet.IP.To4())+m.next)
+			return ip
+		}
+		m.expire()
+	}
+	if len(m.free) == 0 {
+		return nil
+	}
+	ip := m.free[len(m.free)-1]
+	m.free = m.free[:len(m.free)-1]
+	return ip
+}
+
+// expire drops the mappings that were not used for the idle timeout,
+// freeing their addresses. The caller holds the lock.
+func (m *i2pAddrMap) expire() {
+	for name, a := range m.byName {
+		if time.Since(a.used) < i2pAddrIdleTimeout {
+			continue
+		}
+		delete(m.byName, name)
+		delete(m.byAddr, a.ip.String())
+		m.free = append(m.free, a.ip)
+	}
+}
+
+// name returns the .i2p name mapped to the address, or an empty string.
+func (m *i2pAddrMap) name(ip net.IP) string {
+	m.Lock()
+	defer m.Unlock()
+	a, ok := m.byAddr[ip.String()]
+	if !ok {
+		return ""
+	}
+	a.used = time.Now()
+	return a.name
+}
+
+// answer returns the reply to the query if it is about .i2p names or their
+// addresses, or nil. The addresses only live in the plugin, so they get a
+// short ttl.
+func (m *i2pAddrMap) answer(query []byte, name string, qtype uint16, end int) []byte {
+	ttl := uint32(time.Minute / time.Second)
+
+	if qtype == dnsTypePTR {
+		ip := reverseNameIP(name)
+		if ip == nil || !m.virtualNet.Contains(ip) {
+			return nil
+		}
+		if n := m.name(ip); n != "" {
+			return dnsAnswerReply(query, end, qtype, ttl, dnsName(n))
+		}
+		return dnsErrorReply(query, end, dnsRcodeNXDomain)
+	}
+
+	if !isI2PName(name) {
+		return nil
+	}
+	switch qtype {
+	case dnsTypeA:
+		ip := m.addr(name)
+		if ip == nil {
+			return dnsErrorReply(query, end, dnsRcodeServFail)
+		}
+		return dnsAnswerReply(query, end, qtype, ttl, ip)
+	case dnsTypeAAAA:
+		return dnsErrorReply(query, end, 0)
+	}
+	return dnsErrorReply(query, end, dnsRcodeNotImp)
+}
+
+// i2pRules send the tcp connections to the .i2p names to the transparent
+// proxy, which relays them to I2P.
+func (fc *firewallConfig) i2pRules() []firewallRule {
+	if fc.i2pNet == "" {
+		return nil
+	}
+	return []firewallRule{
+		{table: "nat", chain: "PREROUTING", in: fc.bridgeName, dst: fc.i2pNet,
+			proto: "tcp", syn: true, target: "REDIRECT", toPort: proxyPort},
+	}
+}
@@ -0,0 +1,155 @@
+package tor
+
+import (
+	"encoding/binary"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/docker/libnetwork/netlabel"
+)
+
+func TestGetI2P(t *testing.T) {
+	testCases := []struct {
+		value string
+		cidr  string
+		mode  string
+		net   string
+	}{
+		{"", "", "", ""},
+		{"false", "", "", ""},
+		{"true", "", i2pMixed, defaultI2PVirtualAddrNetwork},
+		{"1", "10.64.0.0/16", i2pMixed, "10.64.0.0/16"},
+		{"only", "", i2pOnly, defaultI2PVirtualAddrNetwork},
+	}
+	for _, tc := range testCases {
+		mode, virtualNet, err := getI2P(map[string]interface{}{netlabel.GenericData: map[string]string{
+			i2pOption:                   tc.value,
+			i2pVirtualAddrNetworkOption: tc.cidr,
+		}})
+		if err != nil {
+			t.Fatalf("parsing %q failed: %v", tc.value, err)
+		}
+		var s string
+		if virtualNet != nil {
+			s = virtualNet.String()
+		}
+		if mode != tc.mode || s != tc.net {
+			t.Errorf("expected %q to be %q on %q, got %q on %q", tc.value, tc.mode, tc.net, mode, s)
+		}
+	}
+
+	for _, opts := range []map[string]string{
+		{i2pOption: "sometimes"},
+		{i2pOption: "true", i2pVirtualAddrNetworkOption: "10.128.0.0"},
+		{i2pOption: "true", i2pVirtualAddrNetworkOption: "fd00::/64"},
+	} {
+		if _, _, err := getI2P(map[string]interface{}{netlabel.GenericData: opts}); err == nil {
+			t.Errorf("expected error for %v", opts)
+		}
+	}
+}
+
+func TestI2PAddrMap(t *testing.T) {
+	_, virtualNet, _ := net.ParseCIDR("10.128.0.0/30")
+	m := newI2PAddrMap(virtualNet)
+
+	ip := m.addr("stats.i2p")
+	if !ip.Equal(net.IPv4(10, 128, 0, 1)) {
+		t.Fatalf("expected stats.i2p at 10.128.0.1, got %v", ip)
+	}
+	if again := m.addr("stats.i2p"); !again.Equal(ip) {
+		t.Fatalf("expected stats.i2p to keep its address, got %v", again)
+	}
+	if ip := m.addr("zzz.i2p"); !ip.Equal(net.IPv4(10, 128, 0, 2)) {
+		t.Fatalf("expected zzz.i2p at 10.128.0.2, got %v", ip)
+	}
+	// the broadcast address is never handed out
+	if ip := m.addr("i2pforum.i2p"); ip != nil {
+		t.Fatalf("expected the range to be used up, got %v", ip)
+	}
+	if name := m.name(net.IPv4(10, 128, 0, 1)); name != "stats.i2p" {
+		t.Fatalf("expected 10.128.0.1 to be stats.i2p, got %q", name)
+	}
+
+	// the address of a name that was not used for a while is handed out
+	// again
+	m.byName["zzz.i2p"].used = time.Now().Add(-i2pAddrIdleTimeout)
+	if ip := m.addr("i2pforum.i2p"); !ip.Equal(net.IPv4(10, 128, 0, 2)) {
+		t.Fatalf("expected i2pforum.i2p to get the address of zzz.i2p, got %v", ip)
+	}
+	if name := m.name(net.IPv4(10, 128, 0, 2)); name != "i2pforum.i2p" {
+		t.Fatalf("expected 10.128.0.2 to be i2pforum.i2p, got %q", name)
+	}
+	if _, ok := m.byName["zzz.i2p"]; ok {
+		t.Fatal("expected the idle mapping of zzz.i2p to be dropped")
+	}
+}
+
+func TestDNSServerI2P(t *testing.T) {
+	_, virtualNet, _ := net.ParseCIDR(defaultI2PVirtualAddrNetwork)
+	s := &dnsServer{upstream: "127.0.0.1:1", i2p: newI2PAddrMap(virtualNet)}
+	if err := s.listen("127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	addr := s.udp.LocalAddr().String()
+
+	reply := exchangeUDP(t, addr, dnsQueryType(1, "stats.i2p", dnsTypeA))
+	if binary.BigEndian.Uint16(reply[6:8]) != 1 {
+		t.Fatalf("expected an answer, got rcode %d", reply[3]&0x0f)
+	}
+	_, _, end, err := dnsQuestion(reply)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ip := net.IP(reply[end+12:])
+	if !virtualNet.Contains(ip) {
+		t.Fatalf("expected an address of %s, got %v", virtualNet, ip)
+	}
+
+	reply = exchangeUDP(t, addr, dnsQueryType(2, "1.0.128.10.in-addr.arpa", dnsTypePTR))
+	if binary.BigEndian.Uint16(reply[6:8]) != 1 {
+		t.Fatalf("expected an answer to the reverse lookup, got rcode %d", reply[3]&0x0f)
+	}
+
+	reply = exchangeUDP(t, addr, dnsQueryType(3, "stats.i2p", dnsTypeAAAA))
+	if rcode := reply[3] & 0x0f; rcode != 0 || binary.BigEndian.Uint16(reply[6:8]) != 0 {
+		t.Fatalf("expected an empty answer for AAAA, got rcode %d", rcode)
+	}
+
+	reply = exchangeUDP(t, addr, dnsQueryType(4, "stats.i2p", 15))
+	if rcode := reply[3] & 0x0f; rcode != dnsRcodeNotImp {
+		t.Fatalf("expected NOTIMP for MX, got rcode %d", rcode)
+	}
+}
+
+func TestI2POnlyRules(t *testing.T) {
+	_, addr, _ := net.ParseCIDR("172.18.0.0/16")
+	fc := &firewallConfig{
+		bridgeName: "torbr-1",
+		transPort:  torTransparentProxyPort,
+		addr:       addr,
+		dnsPort:    dnsProxyPort,
+		i2pNet:     defaultI2PVirtualAddrNetwork,
+		i2pOnly:    true,
+	}
+
+	var nat []string
+	var rejects int
+	for _, r := range fc.rules() {
+		if r.table == "nat" && r.target == "REDIRECT" && r.syn {
+			nat = append(nat, strings.Join(r.iptablesArgs(), " "))
+		}
+		if r.target == "REJECT" {
+			rejects++
+		}
+	}
+	if len(nat) != 1 || !strings.Contains(nat[0], "-d "+defaultI2PVirtualAddrNetwork) {
+		t.Fatalf("expected only the i2p range redirected, got %q", nat)
+	}
+	if rejects == 0 {
+		t.Fatal("expected the clearnet to be rejected")
+	}
+}
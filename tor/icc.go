@@ -0,0 +1,71 @@
+package tor
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// getICC parses the inter-container communication option. It is either a
+// boolean, true letting the containers on the network reach each other over
+// any protocol, or a comma separated list of port[/proto] they may reach
+// each other on. It is on by default.
+func getICC(opts map[string]interface{}) (bool, []portSpec, error) {
+	v, ok := getOption(opts, iccOption)
+	if !ok || v == "" {
+		return true, nil, nil
+	}
+	if enabled, err := strconv.ParseBool(v); err == nil {
+		return enabled, nil, nil
+	}
+
+	ports, err := parsePorts(v)
+	if err != nil {
+		return false, nil, fmt.Errorf("Invalid %s: %v", iccOption, err)
+	}
+	return true, ports, nil
+}
+
+// iccRules decide what the containers on the network may send each other.
+// The rules have to come ahead of the udp blocking rules, which would drop
+// udp between the containers as well.
+func (fc *firewallConfig) iccRules() []firewallRule {
+	icc := firewallRule{table: "filter", chain: "FORWARD", in: fc.bridgeName, out: fc.bridgeName}
+	if !fc.icc {
+		icc.target = "DROP"
+		return []firewallRule{icc}
+	}
+	if len(fc.iccPorts) == 0 {
+		icc.target = "ACCEPT"
+		return []firewallRule{icc}
+	}
+
+	// the replies come from the allowed ports
+	established := icc
+	established.ctstate = []string{"RELATED", "ESTABLISHED"}
+	established.target = "ACCEPT"
+	rules := []firewallRule{established}
+	for _, p := range fc.iccPorts {
+		r := icc
+		r.proto, r.dport, r.target = p.proto, p.port, "ACCEPT"
+		rules = append(rules, r)
+	}
+	icc.target = "DROP"
+	return append(rules, icc)
+}
+
+// sandboxICCRules returns the rules of the firewall inside the containers
+// letting out what the network's inter-container communication allows.
+func (n *NetworkState) sandboxICCRules() [][]string {
+	if !n.icc || n.subnet == nil {
+		return nil
+	}
+	if len(n.iccPorts) == 0 {
+		return [][]string{{"-d", n.subnet.String(), "-j", "RETURN"}}
+	}
+
+	var rules [][]string
+	for _, p := range n.iccPorts {
+		rules = append(rules, []string{"-d", n.subnet.String(), "-p", p.proto, "--dport", p.port, "-j", "RETURN"})
+	}
+	return rules
+}
@@ -0,0 +1,72 @@
+package tor
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestGetICC(t *testing.T) {
+	testCases := []struct {
+		value   string
+		enabled bool
+		ports   string
+	}{
+		{"", true, ""},
+		{"false", false, ""},
+		{"true", true, ""},
+		{"80,5353/udp", true, "80/tcp,5353/udp"},
+	}
+	for _, tc := range testCases {
+		enabled, ports, err := getICC(map[string]interface{}{iccOption: tc.value})
+		if err != nil {
+			t.Fatalf("parsing %q failed: %v", tc.value, err)
+		}
+		var p []string
+		for _, port := range ports {
+			p = append(p, port.String())
+		}
+		if enabled != tc.enabled || strings.Join(p, ",") != tc.ports {
+			t.Errorf("expected %q to be %v with ports %q, got %v with ports %q", tc.value, tc.enabled, tc.ports, enabled, p)
+		}
+	}
+
+	if _, _, err := getICC(map[string]interface{}{iccOption: "http"}); err == nil {
+		t.Error("expected error parsing \"http\"")
+	}
+}
+
+func TestICCRules(t *testing.T) {
+	_, addr, _ := net.ParseCIDR("172.18.0.0/16")
+	fc := &firewallConfig{
+		bridgeName: "torbr-1",
+		transPort:  torTransparentProxyPort,
+		addr:       addr,
+		dnsPort:    torDNSPort,
+		blockUDP:   true,
+		icc:        true,
+		iccPorts:   []portSpec{{port: "5353", proto: "udp"}},
+		nflogGroup: 5,
+	}
+
+	var rules []string
+	for _, r := range fc.rules() {
+		if r.chain == "FORWARD" {
+			rules = append(rules, strings.Join(r.iptablesArgs(), " "))
+		}
+	}
+	forward := strings.Join(rules, "\n") + "\n"
+
+	// the allowed udp port has to be let through ahead of the udp drops
+	expected := "-i torbr-1 -o torbr-1 -m conntrack --ctstate RELATED,ESTABLISHED -j ACCEPT\n" +
+		"-i torbr-1 -o torbr-1 -p udp --dport 5353 -j ACCEPT\n" +
+		"-i torbr-1 -o torbr-1 -j DROP\n"
+	if !strings.HasPrefix(forward, expected) {
+		t.Fatalf("expected the forward rules to start with:\n%s\ngot:\n%s", expected, forward)
+	}
+
+	n := &NetworkState{icc: true, iccPorts: fc.iccPorts, subnet: addr}
+	if script := n.sandboxFirewallScript("ONION-OUT-fedcba987654"); !strings.Contains(script, "-A ONION-OUT-fedcba987654 -d 172.18.0.0/16 -p udp --dport 5353 -j RETURN\n") {
+		t.Fatalf("expected the sandbox to let out the allowed udp port:\n%s", script)
+	}
+}
@@ -0,0 +1,143 @@
+package tor
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/docker/docker/api/types"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// isolateContainer puts the streams of each container on the network
+	// on circuits of their own.
+	isolateContainer = "container"
+	// isolateNetwork lets all the containers on the network share circuits.
+	isolateNetwork = "network"
+	// isolateLabelPrefix shares the circuits between the containers with
+	// the same value of a label.
+	isolateLabelPrefix = "label="
+)
+
+// isolation is how the streams of the containers on a network are split
+// into groups that do not share tor circuits.
+type isolation struct {
+	mode  string
+	label string
+}
+
+// getIsolation parses the stream isolation option of a network, which is
+// either container, network or label=<key>. It defaults to container.
+func getIsolation(opts map[string]interface{}) (isolation, error) {
+	v, ok := getOption(opts, isolationOption)
+	if !ok || v == "" {
+		return isolation{mode: isolateContainer}, nil
+	}
+
+	switch {
+	case v == isolateContainer, v == isolateNetwork:
+		return isolation{mode: v}, nil
+	case strings.HasPrefix(v, isolateLabelPrefix) && len(v) > len(isolateLabelPrefix):
+		return isolation{mode: isolateLabelPrefix, label: strings.TrimPrefix(v, isolateLabelPrefix)}, nil
+	}
+	return isolation{}, fmt.Errorf("Invalid %s %q, must be %s, %s or %s<key>", isolationOption, v, isolateContainer, isolateNetwork, isolateLabelPrefix)
+}
+
+// isolationGroup returns the isolation group of the endpoint. The explicit
+// group of an endpoint wins over the isolation of the network, and the
+// containers without the label stay isolated from everything else.
+func (n *NetworkState) isolationGroup(ep *torEndpoint) string {
+	if ep.isolationGroup != "" {
+		return "group:" + ep.isolationGroup
+	}
+
+	switch n.isolation.mode {
+	case isolateNetwork:
+		return "network"
+	case isolateLabelPrefix:
+		c, err := n.endpointContainer(ep)
+		if err != nil {
+			logrus.Warnf("Getting the labels of the container of endpoint %s failed, isolating it: %v", ep.id, err)
+		} else if v, ok := c.labels[n.isolation.label]; ok {
+			return "label:" + n.isolation.label + "=" + v
+		}
+	}
+	return "endpoint:" + ep.id
+}
+
+// isolationGroupByIP returns the isolation group of the container with the
+// address. Addresses without an endpoint are isolated from each other.
+func (n *NetworkState) isolationGroupByIP(ip net.IP) string {
+	if ep := n.endpointByIP(ip); ep != nil {
+		return n.isolationGroup(ep)
+	}
+	return "address:" + ip.String()
+}
+
+// containerInfo is what the driver knows about the container of an
+// endpoint.
+type containerInfo struct {
+	name   string
+	labels map[string]string
+}
+
+// endpointContainer returns the container of the endpoint, looking it up
+// once.
+func (n *NetworkState) endpointContainer(ep *torEndpoint) (*containerInfo, error) {
+	n.Lock()
+	c := ep.container
+	n.Unlock()
+	if c != nil {
+		return c, nil
+	}
+
+	c, err := n.containerInfo(ep.id)
+	if err != nil {
+		return nil, err
+	}
+
+	n.Lock()
+	ep.container = c
+	n.Unlock()
+	return c, nil
+}
+
+// endpointByIP returns the endpoint of the network with the address.
+func (n *NetworkState) endpointByIP(ip net.IP) *torEndpoint {
+	n.Lock()
+	defer n.Unlock()
+
+	for _, ep := range n.endpoints {
+		if ep.addr != nil && ep.addr.IP.Equal(ip) {
+			return ep
+		}
+	}
+	return nil
+}
+
+// containerInfo returns the container attached to the network by the
+// endpoint.
+func (d *Driver) containerInfo(networkID, endpointID string) (*containerInfo, error) {
+	nr, err := d.dcli.NetworkInspect(context.Background(), networkID, types.NetworkInspectOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("inspecting network %s failed: %v", networkID, err)
+	}
+
+	for containerID, er := range nr.Containers {
+		if er.EndpointID != endpointID {
+			continue
+		}
+		c, err := d.dcli.ContainerInspect(context.Background(), containerID)
+		if err != nil {
+			return nil, fmt.Errorf("inspecting container %s failed: %v", containerID, err)
+		}
+		info := &containerInfo{name: strings.TrimPrefix(c.Name, "/"), labels: map[string]string{}}
+		if c.Config != nil && c.Config.Labels != nil {
+			info.labels = c.Config.Labels
+		}
+		return info, nil
+	}
+	return nil, fmt.Errorf("no container has endpoint %s on network %s", endpointID, networkID)
+}
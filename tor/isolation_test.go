@@ -0,0 +1,78 @@
+package tor
+
+import (
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/docker/libnetwork/netlabel"
+)
+
+func TestGetIsolation(t *testing.T) {
+	tests := map[string]isolation{
+		"":             {mode: isolateContainer},
+		"container":    {mode: isolateContainer},
+		"network":      {mode: isolateNetwork},
+		"label=tenant": {mode: isolateLabelPrefix, label: "tenant"},
+	}
+	for v, expected := range tests {
+		opts := map[string]interface{}{netlabel.GenericData: map[string]string{isolationOption: v}}
+		i, err := getIsolation(opts)
+		if err != nil {
+			t.Fatalf("%q: %v", v, err)
+		}
+		if i != expected {
+			t.Fatalf("%q: expected %+v, got %+v", v, expected, i)
+		}
+	}
+
+	for _, v := range []string{"label=", "circuit", "label"} {
+		opts := map[string]interface{}{netlabel.GenericData: map[string]string{isolationOption: v}}
+		if _, err := getIsolation(opts); err == nil {
+			t.Errorf("expected error for %q", v)
+		}
+	}
+}
+
+func TestIsolationGroup(t *testing.T) {
+	labels := map[string]map[string]string{
+		"a": {"tenant": "blue"},
+		"b": {"tenant": "blue"},
+		"c": {"tenant": "red"},
+		"d": {},
+	}
+	n := &NetworkState{
+		isolation: isolation{mode: isolateLabelPrefix, label: "tenant"},
+		endpoints: map[string]*torEndpoint{},
+		containerInfo: func(endpointID string) (*containerInfo, error) {
+			l, ok := labels[endpointID]
+			if !ok {
+				return nil, fmt.Errorf("no container for endpoint %s", endpointID)
+			}
+			return &containerInfo{name: endpointID, labels: l}, nil
+		},
+	}
+	for i, id := range []string{"a", "b", "c", "d", "e"} {
+		n.endpoints[id] = &torEndpoint{id: id, addr: &net.IPNet{IP: net.IPv4(172, 18, 0, byte(i+2))}}
+	}
+	n.endpoints["e"].isolationGroup = "blue"
+
+	expected := map[string]string{
+		"172.18.0.2":  "label:tenant=blue",
+		"172.18.0.3":  "label:tenant=blue",
+		"172.18.0.4":  "label:tenant=red",
+		"172.18.0.5":  "endpoint:d",
+		"172.18.0.6":  "group:blue",
+		"172.18.0.99": "address:172.18.0.99",
+	}
+	for ip, group := range expected {
+		if g := n.isolationGroupByIP(net.ParseIP(ip)); g != group {
+			t.Errorf("%s: expected group %q, got %q", ip, group, g)
+		}
+	}
+
+	n.isolation = isolation{mode: isolateNetwork}
+	if g := n.isolationGroupByIP(net.ParseIP("172.18.0.4")); g != "network" {
+		t.Errorf("expected the network group, got %q", g)
+	}
+}
@@ -0,0 +1,227 @@
+package tor
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"syscall"
+
+	"github.com/sirupsen/logrus"
+	"github.com/vishvananda/netlink/nl"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// leakPrefix is the prefix of the NFLOG rules in front of the drops.
+	leakPrefix = "onion:"
+
+	nfnlSubsysULOG    = 4
+	nfulnlMsgPacket   = nfnlSubsysULOG << 8
+	nfulnlMsgConfig   = nfnlSubsysULOG<<8 | 1
+	nfulaCfgCmd       = 1
+	nfulaCfgMode      = 2
+	nfulaPayload      = 9
+	nfulaPrefix       = 10
+	nfulnlCfgCmdBind  = 1
+	nfulnlCopyPacket  = 2
+	nfulnlCopyRange   = 128 // enough for the ip and transport headers
+	nlaTypeMask       = ^uint16(unix.NLA_F_NESTED | unix.NLA_F_NET_BYTEORDER)
+	ipv4HeaderMinSize = 20
+)
+
+// leakEvent is a packet the firewall blocked from going around tor.
+type leakEvent struct {
+	chain string
+	proto string
+	src   net.IP
+	dst   net.IP
+	dport int
+}
+
+// monitorLeaks reads the packets logged by the NFLOG rules in front of the
+// drops and reports which container tried to send them where, so
+// misbehaving applications can be found.
+func (d *Driver) monitorLeaks(group uint16) error {
+	s, err := nl.Subscribe(unix.NETLINK_NETFILTER)
+	if err != nil {
+		return fmt.Errorf("opening netfilter netlink socket failed: %v", err)
+	}
+	defer s.Close()
+
+	if err := nflogBind(s, group); err != nil {
+		return fmt.Errorf("binding to nflog group %d failed: %v", group, err)
+	}
+	logrus.Infof("Monitoring nflog group %d for packets trying to bypass tor", group)
+
+	for {
+		msgs, err := s.Receive()
+		if err != nil {
+			if err == syscall.ENOBUFS {
+				// we are too slow and the kernel dropped some, keep going
+				logrus.Warn("Leak monitor lost events, the netlink socket buffer is full")
+				continue
+			}
+			return err
+		}
+		for _, m := range msgs {
+			if m.Header.Type != nfulnlMsgPacket || len(m.Data) < nl.SizeofNfgenmsg {
+				continue
+			}
+			ev, err := parseNflogPacket(m.Data[nl.SizeofNfgenmsg:])
+			if err != nil {
+				logrus.Debugf("Skipping nflog packet: %v", err)
+				continue
+			}
+			d.reportLeak(ev)
+		}
+	}
+}
+
+// nflogBind binds the socket to the nflog group and asks for the start of
+// each packet to be copied along.
+func nflogBind(s *nl.NetlinkSocket, group uint16) error {
+	mode := make([]byte, 6)
+	mode[0], mode[1], mode[2], mode[3] = 0, 0, nfulnlCopyRange>>8, nfulnlCopyRange&0xff
+	mode[4] = nfulnlCopyPacket
+
+	for _, attr := range []*nl.RtAttr{
+		nl.NewRtAttr(nfulaCfgCmd, []byte{nfulnlCfgCmdBind}),
+		nl.NewRtAttr(nfulaCfgMode, mode),
+	} {
+		req := nl.NewNetlinkRequest(nfulnlMsgConfig, unix.NLM_F_ACK)
+		req.AddData(&nl.Nfgenmsg{
+			NfgenFamily: unix.AF_UNSPEC,
+			Version:     nl.NFNETLINK_V0,
+			ResId:       nl.Swap16(group),
+		})
+		req.AddData(attr)
+		if err := s.Send(req); err != nil {
+			return err
+		}
+
+		msgs, err := s.Receive()
+		if err != nil {
+			return err
+		}
+		for _, m := range msgs {
+			if m.Header.Type != unix.NLMSG_ERROR || len(m.Data) < 4 {
+				continue
+			}
+			if errno := int32(nl.NativeEndian().Uint32(m.Data[0:4])); errno != 0 {
+				return syscall.Errno(-errno)
+			}
+		}
+	}
+	return nil
+}
+
+// parseNflogPacket parses the attributes of an nflog packet message.
+func parseNflogPacket(b []byte) (*leakEvent, error) {
+	attrs, err := nl.ParseRouteAttr(b)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		prefix  string
+		payload []byte
+	)
+	for _, a := range attrs {
+		switch a.Attr.Type & nlaTypeMask {
+		case nfulaPrefix:
+			prefix = strings.TrimRight(string(a.Value), "\x00")
+		case nfulaPayload:
+			payload = a.Value
+		}
+	}
+
+	if !strings.HasPrefix(prefix, leakPrefix) {
+		return nil, fmt.Errorf("not logged by onion: %q", prefix)
+	}
+
+	ev, err := parseIPv4Packet(payload)
+	if err != nil {
+		return nil, err
+	}
+	ev.chain = strings.TrimPrefix(prefix, leakPrefix)
+	return ev, nil
+}
+
+// parseIPv4Packet gets the protocol, addresses and destination port out of
+// the headers of the packet.
+func parseIPv4Packet(b []byte) (*leakEvent, error) {
+	if len(b) < ipv4HeaderMinSize || b[0]>>4 != 4 {
+		return nil, fmt.Errorf("not an ipv4 packet")
+	}
+	ihl := int(b[0]&0x0f) * 4
+	if ihl < ipv4HeaderMinSize || len(b) < ihl {
+		return nil, fmt.Errorf("invalid ipv4 header length %d", ihl)
+	}
+
+	ev := &leakEvent{
+		src: net.IP(append([]byte{}, b[12:16]...)),
+		dst: net.IP(append([]byte{}, b[16:20]...)),
+	}
+	switch b[9] {
+	case unix.IPPROTO_TCP:
+		ev.proto = "tcp"
+	case unix.IPPROTO_UDP:
+		ev.proto = "udp"
+	case unix.IPPROTO_ICMP:
+		ev.proto = "icmp"
+	default:
+		ev.proto = fmt.Sprintf("%d", b[9])
+	}
+	if (ev.proto == "tcp" || ev.proto == "udp") && len(b) >= ihl+4 {
+		ev.dport = int(b[ihl+2])<<8 | int(b[ihl+3])
+	}
+	return ev, nil
+}
+
+// reportLeak logs the event and counts it against the container that sent
+// or was about to receive the packet.
+func (d *Driver) reportLeak(ev *leakEvent) {
+	fields := logrus.Fields{
+		"chain":    ev.chain,
+		"protocol": ev.proto,
+		"source":   ev.src.String(),
+		"dest":     ev.dst.String(),
+	}
+	if ev.dport != 0 {
+		fields["dport"] = ev.dport
+	}
+
+	key := "unknown"
+	n, ep := d.endpointByIP(ev.src)
+	if ep == nil {
+		n, ep = d.endpointByIP(ev.dst)
+	}
+	if ep != nil {
+		fields["network"], fields["endpoint"] = n.id, ep.id
+		key = ep.id
+		if c, err := n.endpointContainer(ep); err != nil {
+			logrus.Debugf("Getting the container of endpoint %s for the leak report failed: %v", ep.id, err)
+			if u, ok := n.accounting.endpoint(ep.id); ok && u.Container != "" {
+				fields["container"], key = u.Container, u.Container
+			}
+		} else {
+			fields["container"], key = c.name, c.name
+		}
+	}
+	leaks.Add(key+"/"+ev.proto, 1)
+
+	logrus.WithFields(fields).Warn("Blocked packet trying to bypass tor")
+}
+
+// endpointByIP returns the endpoint with the address, and its network.
+func (d *Driver) endpointByIP(ip net.IP) (*NetworkState, *torEndpoint) {
+	d.Lock()
+	defer d.Unlock()
+
+	for _, ns := range d.networks {
+		if ep := ns.endpointByIP(ip); ep != nil {
+			return ns, ep
+		}
+	}
+	return nil, nil
+}
@@ -0,0 +1,87 @@
+package tor
+
+import (
+	"expvar"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/vishvananda/netlink/nl"
+)
+
+func TestParseNflogPacket(t *testing.T) {
+	// udp packet from 172.18.0.2 to 8.8.8.8:53
+	payload := []byte{
+		0x45, 0x00, 0x00, 0x1c, 0x00, 0x00, 0x40, 0x00, 0x40, 0x11, 0x00, 0x00,
+		172, 18, 0, 2,
+		8, 8, 8, 8,
+		0xc3, 0x50, 0x00, 0x35, 0x00, 0x08, 0x00, 0x00,
+	}
+
+	var b []byte
+	b = append(b, nl.NewRtAttr(nfulaPrefix, nl.ZeroTerminated(leakPrefix+"FORWARD")).Serialize()...)
+	b = append(b, nl.NewRtAttr(nfulaPayload, payload).Serialize()...)
+
+	ev, err := parseNflogPacket(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ev.chain != "FORWARD" {
+		t.Errorf("expected chain FORWARD, got %s", ev.chain)
+	}
+	if ev.proto != "udp" {
+		t.Errorf("expected protocol udp, got %s", ev.proto)
+	}
+	if ev.src.String() != "172.18.0.2" || ev.dst.String() != "8.8.8.8" {
+		t.Errorf("expected 172.18.0.2 -> 8.8.8.8, got %s -> %s", ev.src, ev.dst)
+	}
+	if ev.dport != 53 {
+		t.Errorf("expected destination port 53, got %d", ev.dport)
+	}
+
+	// packets logged by someone else are skipped
+	b = nl.NewRtAttr(nfulaPrefix, nl.ZeroTerminated("other")).Serialize()
+	b = append(b, nl.NewRtAttr(nfulaPayload, payload).Serialize()...)
+	if _, err := parseNflogPacket(b); err == nil {
+		t.Fatal("expected an error for a packet without the onion prefix")
+	}
+}
+
+func TestReportLeakContainer(t *testing.T) {
+	n := &NetworkState{
+		id: "0123456789abcdef",
+		endpoints: map[string]*torEndpoint{
+			"fedcba9876543210": {id: "fedcba9876543210", addr: &net.IPNet{IP: net.IPv4(172, 18, 0, 2)}},
+		},
+		containerInfo: func(endpointID string) (*containerInfo, error) {
+			return &containerInfo{name: "web"}, nil
+		},
+	}
+	d := &Driver{networks: map[string]*NetworkState{n.id: n}}
+
+	before := leakCount("web/udp")
+	d.reportLeak(&leakEvent{chain: "FORWARD", proto: "udp", src: net.IPv4(172, 18, 0, 2), dst: net.IPv4(8, 8, 8, 8), dport: 53})
+	if got := leakCount("web/udp"); got != before+1 {
+		t.Fatalf("expected the leak to be counted against the container, got %d", got-before)
+	}
+}
+
+func TestLogRejects(t *testing.T) {
+	fc := &firewallConfig{bridgeName: "torbr-1", nflogGroup: 5}
+	rules := fc.logDrops([]firewallRule{
+		{chain: "FORWARD", in: "torbr-1", out: "!torbr-1", proto: "tcp", target: "REJECT", rejectWith: "tcp-reset"},
+	})
+	if len(rules) != 2 {
+		t.Fatalf("expected the reject to be logged, got %d rules", len(rules))
+	}
+	if l := rules[0]; l.target != "NFLOG" || l.rejectWith != "" {
+		t.Fatalf("expected an NFLOG rule without --reject-with, got %q", strings.Join(l.iptablesArgs(), " "))
+	}
+}
+
+func leakCount(key string) int64 {
+	if v, ok := leaks.Get(key).(*expvar.Int); ok {
+		return v.Value()
+	}
+	return 0
+}
@@ -0,0 +1,39 @@
+package tor
+
+import (
+	"expvar"
+)
+
+// The counters are published with expvar, they are served on /debug/vars
+// when the plugin is started with a metrics address.
+var (
+	// firewallDrift counts the times a network's firewall rules were found
+	// missing, keyed by network id.
+	firewallDrift = expvar.NewMap("onion_firewall_drift_total")
+	// leaks counts the packets the firewall blocked from going around tor,
+	// keyed by container name, or endpoint id when it is not known, and
+	// protocol.
+	leaks = expvar.NewMap("onion_leaks_total")
+	// rateLimited counts the new connections into tor dropped for going
+	// over the rate limit, keyed by endpoint id.
+	rateLimited = expvar.NewMap("onion_rate_limited_total")
+	// dnsPolicyHits counts the names the dns policy of a network decided
+	// on, keyed by network id, allow or deny, and the rule.
+	dnsPolicyHits = expvar.NewMap("onion_dns_policy_total")
+	// hostPolicyHits counts the hostnames of the proxied connections the
+	// host policy of a network decided on, keyed like dnsPolicyHits.
+	hostPolicyHits = expvar.NewMap("onion_host_policy_total")
+	// endpointConnections, endpointBytesSent and endpointBytesReceived
+	// count the connections the transparent proxy relayed and their bytes,
+	// keyed by endpoint id. They carry on from the accounting file.
+	endpointConnections   = expvar.NewMap("onion_endpoint_connections_total")
+	endpointBytesSent     = expvar.NewMap("onion_endpoint_bytes_sent_total")
+	endpointBytesReceived = expvar.NewMap("onion_endpoint_bytes_received_total")
+	// streamsQueued and streamsRejected count the connections the
+	// transparent proxy held back or reset for going over the stream
+	// limits, and streamsIdleTimedOut the ones it closed for being idle,
+	// keyed by endpoint id.
+	streamsQueued       = expvar.NewMap("onion_streams_queued_total")
+	streamsRejected     = expvar.NewMap("onion_streams_rejected_total")
+	streamsIdleTimedOut = expvar.NewMap("onion_streams_idle_timeout_total")
+)
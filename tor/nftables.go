@@ -0,0 +1,304 @@
+package tor
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// nftChains maps the chains of the policy to the base chains of a
+// network's nftables table.
+var nftChains = []struct {
+	table, chain string
+	name, spec   string
+}{
+	{"nat", "PREROUTING", "prerouting", "type nat hook prerouting priority -100; policy accept;"},
+	{"nat", "POSTROUTING", "postrouting", "type nat hook postrouting priority 100; policy accept;"},
+	{"filter", "INPUT", "input", "type filter hook input priority 0; policy accept;"},
+	{"filter", "FORWARD", "forward", "type filter hook forward priority 0; policy accept;"},
+}
+
+// nftablesFirewall programs the policy with nftables. Each network gets a
+// table of its own which is replaced as a whole, so the rules are updated
+// atomically.
+//
+// An accept in one table does not stop a packet from being dropped by
+// another table hooked in at the same place, only drops are final. So the
+// network is refused while the iptables FORWARD chain drops what it does
+// not accept, as it does once docker set it up, the traffic of the
+// containers would never make it to tor. Port mappings are refused too,
+// those are programmed by the libnetwork portmapper which only knows about
+// iptables.
+type nftablesFirewall struct{}
+
+func (f *nftablesFirewall) program(n *NetworkState, rules []firewallRule) error {
+	if err := iptablesForwardDrops(); err != nil {
+		return err
+	}
+	script, err := nftScript(nftTableName(n.BridgeName), rules)
+	if err != nil {
+		return err
+	}
+	logrus.Debugf("Programming nftables for bridge %s:\n%s", n.BridgeName, script)
+	return nft(script)
+}
+
+func (f *nftablesFirewall) cleanup(n *NetworkState) error {
+	table := nftTableName(n.BridgeName)
+	// declaring the table first makes deleting it work even if it is gone
+	return nft(fmt.Sprintf("table ip %s\ndelete table ip %s\n", table, table))
+}
+
+func (f *nftablesFirewall) check(n *NetworkState, rules []firewallRule) ([]firewallRule, error) {
+	output, err := exec.Command("nft", "list", "table", "ip", nftTableName(n.BridgeName)).CombinedOutput()
+	if err != nil {
+		if strings.Contains(string(output), "No such file or directory") {
+			// the whole table is gone
+			return rules, nil
+		}
+		return nil, fmt.Errorf("nft list table failed: %v: %s", err, strings.TrimSpace(string(output)))
+	}
+
+	// nft prints the rules in its own canonical form, which changes
+	// between versions, so compare the tags the rules were programmed with
+	// rather than the rules themselves
+	comments := nftRuleComments(string(output))
+	var missing []firewallRule
+	for _, c := range nftChains {
+		var expected []firewallRule
+		for _, r := range rules {
+			if r.table == c.table && r.chain == c.chain {
+				expected = append(expected, r)
+			}
+		}
+		drifted, err := n.driftedRules(expected, comments[c.name], func(r firewallRule) (string, error) {
+			expr, err := r.nftExpr()
+			return ruleTag(expr), err
+		})
+		if err != nil {
+			return nil, err
+		}
+		missing = append(missing, drifted...)
+	}
+	return missing, nil
+}
+
+// shadowed returns nothing, nftables evaluates every base chain hooked at
+// the same place and a drop in any of them is final, so an accept in
+// another table cannot let the network's traffic around the policy.
+func (f *nftablesFirewall) shadowed(n *NetworkState) ([]string, error) {
+	return nil, nil
+}
+
+// counters reads the counters of the rules in the network's table.
+func (f *nftablesFirewall) counters(n *NetworkState) (map[string]uint64, error) {
+	output, err := exec.Command("nft", "list", "table", "ip", nftTableName(n.BridgeName)).CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("nft list table failed: %v: %s", err, strings.TrimSpace(string(output)))
+	}
+	return nftCounters(string(output)), nil
+}
+
+var (
+	nftCounterRegexp = regexp.MustCompile(`counter packets (\d+) bytes \d+ .*comment "([^"]*)"`)
+	nftCommentRegexp = regexp.MustCompile(`comment "([^"]*)"\s*$`)
+)
+
+// nftCounters parses the packet counters of the rules with a comment from
+// the output of `nft list table`.
+func nftCounters(output string) map[string]uint64 {
+	counters := map[string]uint64{}
+	for _, m := range nftCounterRegexp.FindAllStringSubmatch(output, -1) {
+		comment, _ := splitRuleComment(m[2])
+		if comment == "" {
+			continue
+		}
+		packets, _ := strconv.ParseUint(m[1], 10, 64)
+		counters[comment] += packets
+	}
+	return counters
+}
+
+// nftRuleComments returns the comments of the rules in each chain of the
+// output of `nft list table`, in order, empty for rules without one.
+func nftRuleComments(output string) map[string][]string {
+	comments := map[string][]string{}
+	chain := ""
+	for _, line := range strings.Split(output, "\n") {
+		line = strings.TrimSpace(line)
+		switch {
+		case strings.HasPrefix(line, "chain "):
+			chain = strings.TrimSuffix(strings.TrimSpace(strings.TrimPrefix(line, "chain ")), " {")
+		case line == "}":
+			chain = ""
+		case chain != "" && line != "" && !strings.HasPrefix(line, "type "):
+			var comment string
+			if m := nftCommentRegexp.FindStringSubmatch(line); m != nil {
+				comment = m[1]
+			}
+			comments[chain] = append(comments[chain], comment)
+		}
+	}
+	return comments
+}
+
+// nftTableName returns the name of the nftables table for the bridge.
+func nftTableName(bridgeName string) string {
+	return "onion_" + strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') {
+			return r
+		}
+		return '_'
+	}, bridgeName)
+}
+
+// nftScript renders the rules as a script for `nft -f` that replaces the
+// table in one transaction.
+func nftScript(table string, rules []firewallRule) (string, error) {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "table ip %s\ndelete table ip %s\n", table, table)
+	fmt.Fprintf(&b, "table ip %s {\n", table)
+	for _, c := range nftChains {
+		fmt.Fprintf(&b, "\tchain %s {\n\t\t%s\n", c.name, c.spec)
+		for _, r := range rules {
+			if r.table != c.table || r.chain != c.chain {
+				continue
+			}
+			expr, err := r.nftTagged()
+			if err != nil {
+				return "", err
+			}
+			fmt.Fprintf(&b, "\t\t%s\n", expr)
+		}
+		b.WriteString("\t}\n")
+	}
+	b.WriteString("}\n")
+	return b.String(), nil
+}
+
+// nftTagged renders the rule as an nftables rule expression with its tag
+// added to the comment, for check to find it again.
+func (r firewallRule) nftTagged() (string, error) {
+	expr, err := r.nftExpr()
+	if err != nil {
+		return "", err
+	}
+	return r.nftRender(strings.TrimSpace(r.comment + " " + ruleTag(expr)))
+}
+
+// nftExpr renders the rule as an nftables rule expression.
+func (r firewallRule) nftExpr() (string, error) {
+	return r.nftRender(r.comment)
+}
+
+func (r firewallRule) nftRender(comment string) (string, error) {
+	var e []string
+	iface := func(key, name string) {
+		if strings.HasPrefix(name, "!") {
+			e = append(e, fmt.Sprintf("%s != %q", key, strings.TrimPrefix(name, "!")))
+		} else if name != "" {
+			e = append(e, fmt.Sprintf("%s %q", key, name))
+		}
+	}
+
+	iface("iifname", r.in)
+	iface("oifname", r.out)
+	if r.src != "" {
+		e = append(e, "ip saddr "+r.src)
+	}
+	if r.dst != "" {
+		e = append(e, "ip daddr "+r.dst)
+	}
+	if r.proto != "" && r.sport == "" && r.dport == "" && !r.syn && !r.notSyn {
+		e = append(e, "meta l4proto "+r.proto)
+	}
+	if r.sport != "" {
+		e = append(e, r.proto+" sport "+strings.Replace(r.sport, ":", "-", 1))
+	}
+	if r.dport != "" {
+		e = append(e, r.proto+" dport "+strings.Replace(r.dport, ":", "-", 1))
+	}
+	if r.syn {
+		e = append(e, "tcp flags & (fin|syn|rst|ack) == syn")
+	}
+	if r.notSyn {
+		e = append(e, "tcp flags & (fin|syn|rst|ack) != syn")
+	}
+	if r.srcLocal {
+		e = append(e, "fib saddr type local")
+	}
+	if len(r.ctstate) > 0 {
+		e = append(e, "ct state "+strings.ToLower(strings.Join(r.ctstate, ",")))
+	}
+
+	if r.rateAbove > 0 {
+		e = append(e, fmt.Sprintf("limit rate over %d/second burst %d packets", r.rateAbove, r.rateBurst))
+	}
+	if r.comment != "" {
+		e = append(e, "counter")
+	}
+
+	switch r.target {
+	case "ACCEPT", "DROP", "RETURN", "MASQUERADE":
+		e = append(e, strings.ToLower(r.target))
+	case "REJECT":
+		if r.rejectWith == "tcp-reset" {
+			e = append(e, "reject with tcp reset")
+		} else {
+			e = append(e, "reject")
+		}
+	case "REDIRECT":
+		e = append(e, "redirect to :"+r.toPort)
+	case "NFLOG":
+		e = append(e, fmt.Sprintf("log prefix %q group %d", r.nflogPrefix, r.nflogGroup))
+	default:
+		return "", fmt.Errorf("unsupported nftables target %q in rule %s", r.target, r)
+	}
+
+	if comment != "" {
+		e = append(e, fmt.Sprintf("comment %q", comment))
+	}
+
+	return strings.Join(e, " "), nil
+}
+
+// iptablesForwardDrops returns an error if the iptables FORWARD chain drops
+// the packets none of its rules accept, the accepts of the network's table
+// cannot override that. Hosts without iptables have nothing to drop them.
+func iptablesForwardDrops() error {
+	output, err := exec.Command("iptables", "-S", "FORWARD").CombinedOutput()
+	if err != nil {
+		logrus.Debugf("Reading the iptables FORWARD policy failed, assuming there is none: %v: %s", err, strings.TrimSpace(string(output)))
+		return nil
+	}
+	if iptablesPolicy(string(output), "FORWARD") == "DROP" {
+		return fmt.Errorf("the iptables FORWARD chain drops by default, which the %s firewall backend cannot override, use the %s backend", NftablesBackend, IptablesBackend)
+	}
+	return nil
+}
+
+// iptablesPolicy returns the policy of the chain from the output of
+// `iptables -S`.
+func iptablesPolicy(output, chain string) string {
+	for _, line := range strings.Split(output, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 3 && fields[0] == "-P" && fields[1] == chain {
+			return fields[2]
+		}
+	}
+	return ""
+}
+
+func nft(script string) error {
+	cmd := exec.Command("nft", "-f", "-")
+	cmd.Stdin = strings.NewReader(script)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("nft failed: %v: %s", err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
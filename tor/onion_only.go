@@ -0,0 +1,63 @@
+package tor
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+const (
+	// defaultVirtualAddrNetwork is the VirtualAddrNetworkIPv4 tor maps
+	// the .onion names it resolves into.
+	defaultVirtualAddrNetwork = "10.192.0.0/10"
+)
+
+// getOnionOnly parses the onion-only options, returning whether the network
+// is onion-only and the virtual address range of tor.
+func getOnionOnly(opts map[string]interface{}) (bool, *net.IPNet, error) {
+	v, ok := getOption(opts, onionOnlyOption)
+	if !ok || v == "" {
+		return false, nil, nil
+	}
+	onionOnly, err := strconv.ParseBool(v)
+	if err != nil {
+		return false, nil, fmt.Errorf("Invalid %s %q: %v", onionOnlyOption, v, err)
+	}
+	if !onionOnly {
+		return false, nil, nil
+	}
+
+	cidr := defaultVirtualAddrNetwork
+	if v, ok := getOption(opts, virtualAddrNetworkOption); ok && v != "" {
+		cidr = v
+	}
+	_, virtualNet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return false, nil, fmt.Errorf("Invalid %s %q: %v", virtualAddrNetworkOption, cidr, err)
+	}
+	if virtualNet.IP.To4() == nil {
+		return false, nil, ErrUnsupportedAddressType(cidr)
+	}
+
+	return true, virtualNet, nil
+}
+
+// isOnionName returns whether the name is a .onion name.
+func isOnionName(name string) bool {
+	name = strings.TrimSuffix(strings.ToLower(name), ".")
+	return strings.HasSuffix(name, ".onion")
+}
+
+// rejectClearnet resets the tcp connections of an onion-only or i2p-only
+// network that are not to the virtual addresses, those are not redirected
+// into tor or I2P.
+func (fc *firewallConfig) rejectClearnet() []firewallRule {
+	if !fc.onionOnly && !fc.i2pOnly {
+		return nil
+	}
+	return []firewallRule{
+		{table: "filter", chain: "FORWARD", in: fc.bridgeName, out: "!" + fc.bridgeName, proto: "tcp",
+			target: "REJECT", rejectWith: "tcp-reset"},
+	}
+}
@@ -0,0 +1,249 @@
+package tor
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/sirupsen/logrus"
+)
+
+// firewallConfig holds what is needed to build the firewall policy of a
+// tor network.
+type firewallConfig struct {
+	bridgeName  string
+	addr        *net.IPNet
+	hairpinMode bool
+	icc         bool
+	iccPorts    []portSpec
+	ipMasqMode  bool
+	blockUDP    bool
+	bypass      []bypassRule
+	hostAllow   []portSpec
+	nflogGroup  uint16
+	onionOnly   bool
+	virtualNet  string
+	i2pNet      string
+	i2pOnly     bool
+	dnsPort     string
+	transPort   string
+	egressAllow []string
+	egressDeny  []string
+	rateLimits  []endpointRateLimit
+}
+
+func (n *NetworkState) firewallConfig() (*firewallConfig, error) {
+	ipnet, err := n.host.ifaceAddr(n.BridgeName)
+	if err != nil {
+		return nil, fmt.Errorf("cannot acquire interface address for bridge %s: %v", n.BridgeName, err)
+	}
+
+	fc := &firewallConfig{
+		bridgeName:  n.BridgeName,
+		hairpinMode: hairpinMode,
+		icc:         n.icc,
+		iccPorts:    n.iccPorts,
+		ipMasqMode:  true,
+		blockUDP:    n.blockUDP,
+		bypass:      n.bypass,
+		hostAllow:   n.hostAllow,
+		nflogGroup:  n.nflogGroup,
+		onionOnly:   n.onionOnly,
+		dnsPort:     torDNSPort,
+		transPort:   torTransparentProxyPort,
+		egressAllow: n.egressAllow,
+		egressDeny:  n.egressDeny,
+	}
+	fc.rateLimits = n.endpointRateLimits()
+	if n.proxyUpstream != nil {
+		fc.transPort = proxyPort
+	}
+	if n.onionOnly {
+		fc.virtualNet = n.virtualNet.String()
+		fc.dnsPort = dnsProxyPort
+	}
+	if n.i2pAddrs != nil {
+		fc.i2pNet = n.i2pNet.String()
+		fc.i2pOnly = n.i2p == i2pOnly
+	}
+	if n.resolverUpstream != nil || n.dnsPolicy != nil || n.audit != nil || n.i2pAddrs != nil {
+		fc.dnsPort = dnsProxyPort
+	}
+
+	fc.addr = &net.IPNet{
+		IP:   ipnet.IP.Mask(ipnet.Mask),
+		Mask: ipnet.Mask,
+	}
+
+	return fc, nil
+}
+
+// setupFirewall programs the policy of the network with its firewall backend.
+func (n *NetworkState) setupFirewall() error {
+	if err := n.updateFirewall(); err != nil {
+		return err
+	}
+
+	// established flows are not affected by the new rules
+	if err := n.host.flushConntrack(n.subnet); err != nil {
+		logrus.Warnf("Failed to flush conntrack entries for bridge %s: %v", n.BridgeName, err)
+	}
+
+	return nil
+}
+
+// updateFirewall programs the rules of the network again, leaving the
+// established flows alone. It is enough when endpoints come and go: their
+// rate limits never let through what the rules before them blocked.
+func (n *NetworkState) updateFirewall() error {
+	n.Lock()
+	defer n.Unlock()
+
+	fc, err := n.firewallConfig()
+	if err != nil {
+		return fmt.Errorf("Failed to setup firewall: %v", err)
+	}
+
+	// only warn about the bypass when the network is created
+	if n.rules == nil {
+		fc.logBypass()
+	}
+
+	if err := n.programFirewall(fc.rules()); err != nil {
+		return fmt.Errorf("setup firewall failed for bridge %s: %v", n.BridgeName, err)
+	}
+	n.subnet = fc.addr
+	return nil
+}
+
+// programFirewall programs the rules, keeping what the rules they replace
+// matched. The caller holds the lock of the network.
+func (n *NetworkState) programFirewall(rules []firewallRule) error {
+	n.collectCounters()
+	if err := n.firewall.program(n, rules); err != nil {
+		return err
+	}
+	n.rules = rules
+	n.counters = nil
+	return nil
+}
+
+// rules returns the policy of the network. The rules are in the order they
+// should be evaluated in within their chain.
+func (fc *firewallConfig) rules() []firewallRule {
+	var rules []firewallRule
+	rules = append(rules, fc.bypassTor()...)
+	rules = append(rules, fc.restrictEgress()...)
+	rules = append(rules, fc.iccRules()...)
+	rules = append(rules, fc.forwardToTor()...)
+	rules = append(rules, fc.rejectClearnet()...)
+	rules = append(rules, fc.masqueradeRules()...)
+	rules = append(rules, fc.forwardRules()...)
+	rules = append(rules, fc.limitConnections()...)
+	rules = append(rules, fc.restrictHostAccess()...)
+	return fc.logDrops(rules)
+}
+
+// logDrops puts an NFLOG rule with the same matches in front of every drop
+// and reject, so the leak monitor gets to see what is being blocked.
+func (fc *firewallConfig) logDrops(rules []firewallRule) []firewallRule {
+	if fc.nflogGroup == 0 {
+		return rules
+	}
+
+	logged := make([]firewallRule, 0, len(rules))
+	for _, r := range rules {
+		// going over the rate limit is not a leak, neither is what the
+		// containers send each other
+		blocks := r.target == "DROP" || r.target == "REJECT"
+		if blocks && r.rateAbove == 0 && !(r.in == fc.bridgeName && r.out == fc.bridgeName) {
+			l := r
+			l.target = "NFLOG"
+			l.rejectWith = ""
+			l.nflogGroup = fc.nflogGroup
+			l.nflogPrefix = leakPrefix + r.chain
+			logged = append(logged, l)
+		}
+		logged = append(logged, r)
+	}
+	return logged
+}
+
+func (fc *firewallConfig) masqueradeRules() []firewallRule {
+	var rules []firewallRule
+
+	// Set NAT.
+	if fc.ipMasqMode {
+		rules = append(rules, firewallRule{table: "nat", chain: "POSTROUTING",
+			src: fc.addr.String(), out: "!" + fc.bridgeName, target: "MASQUERADE"})
+	}
+
+	// In hairpin mode, masquerade traffic from localhost
+	if fc.hairpinMode {
+		rules = append(rules, firewallRule{table: "nat", chain: "POSTROUTING",
+			srcLocal: true, out: fc.bridgeName, target: "MASQUERADE"})
+	}
+
+	return rules
+}
+
+func (fc *firewallConfig) forwardRules() []firewallRule {
+	return []firewallRule{
+		// Set Accept on incoming packets for existing connections.
+		{table: "filter", chain: "FORWARD", out: fc.bridgeName,
+			ctstate: []string{"RELATED", "ESTABLISHED"}, target: "ACCEPT"},
+		// Set Accept on all non-intercontainer outgoing packets.
+		{table: "filter", chain: "FORWARD", in: fc.bridgeName, out: "!" + fc.bridgeName, target: "ACCEPT"},
+	}
+}
+
+func (fc *firewallConfig) forwardToTor() []firewallRule {
+	rules := []firewallRule{
+		// route dns requests, tor's DNSPort only speaks udp so dns over tcp
+		// goes to the plugin which forwards it over udp
+		{table: "nat", chain: "PREROUTING", in: fc.bridgeName, proto: "udp", dport: "53",
+			target: "REDIRECT", toPort: fc.dnsPort},
+		{table: "nat", chain: "PREROUTING", in: fc.bridgeName, proto: "tcp", dport: "53",
+			target: "REDIRECT", toPort: dnsProxyPort},
+		// traffic between the containers and to the host stays off tor
+		{table: "nat", chain: "PREROUTING", in: fc.bridgeName, dst: fc.addr.String(), target: "RETURN"},
+	}
+
+	// route tcp requests, the .i2p names first as their addresses would
+	// otherwise go to tor, onion-only networks only get to tor's virtual
+	// addresses, i2p-only networks not to tor at all and with an egress
+	// allow list only the allowed ports are routed
+	rules = append(rules, fc.i2pRules()...)
+	redirect := firewallRule{table: "nat", chain: "PREROUTING", in: fc.bridgeName, dst: fc.virtualNet,
+		proto: "tcp", syn: true, target: "REDIRECT", toPort: fc.transPort}
+	if !fc.i2pOnly {
+		if len(fc.egressAllow) == 0 {
+			rules = append(rules, redirect)
+		}
+		for _, port := range fc.egressAllow {
+			r := redirect
+			r.dport = port
+			rules = append(rules, r)
+		}
+	}
+
+	// a connection whose flow was flushed comes back as a new flow that
+	// does not start with a syn, which the redirects skip, reset it rather
+	// than letting it carry on around tor
+	rules = append(rules, firewallRule{table: "filter", chain: "FORWARD",
+		in: fc.bridgeName, out: "!" + fc.bridgeName, proto: "tcp", notSyn: true, ctstate: []string{"NEW"},
+		target: "REJECT", rejectWith: "tcp-reset"})
+
+	// tor only carries tcp, icmp would go out in the clear
+	rules = append(rules, firewallRule{table: "filter", chain: "FORWARD",
+		in: fc.bridgeName, out: "!" + fc.bridgeName, proto: "icmp", target: "DROP"})
+
+	// block udp traffic
+	if fc.blockUDP {
+		rules = append(rules,
+			firewallRule{table: "filter", chain: "FORWARD", in: fc.bridgeName, proto: "udp", target: "DROP"},
+			firewallRule{table: "filter", chain: "FORWARD", out: fc.bridgeName, proto: "udp", target: "DROP"},
+		)
+	}
+
+	return rules
+}
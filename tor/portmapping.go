@@ -33,7 +33,17 @@ func (n *NetworkState) getEndpoint(eid string) (*torEndpoint, error) {
 }
 
 func (n *NetworkState) allocatePorts(epConfig *endpointConfiguration, ep *torEndpoint, reqDefBindIP net.IP, ulPxyEnabled bool) ([]types.PortBinding, error) {
-	if epConfig == nil || epConfig.PortBindings == nil {
+	if epConfig == nil || len(epConfig.PortBindings) == 0 {
+		return nil, nil
+	}
+
+	// the portmapper can only program iptables, the ports would not be
+	// published at all
+	if _, ok := n.firewall.(*nftablesFirewall); ok {
+		return nil, fmt.Errorf("Port mappings are only supported with the %s firewall backend", IptablesBackend)
+	}
+	// nothing set up the portmapper on a dry run
+	if n.filterChain == nil {
 		return nil, nil
 	}
 
@@ -0,0 +1,394 @@
+package tor
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/net/proxy"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// proxyPort is where the built-in transparent proxy of a network
+	// listens on its gateway.
+	proxyPort = "22355"
+	// soOriginalDst is the socket option returning the destination of a
+	// connection before it was redirected, from linux/netfilter_ipv4.h.
+	soOriginalDst = 80
+
+	proxyDialTimeout = 30 * time.Second
+)
+
+var errHostnameNotAllowed = errors.New("hostname not allowed")
+
+// parseProxyUpstream parses the URL of an upstream proxy, for example
+// socks5://127.0.0.1:9050, which has to have one of the schemes.
+func parseProxyUpstream(upstream string, schemes ...string) (*url.URL, error) {
+	u, err := url.Parse(upstream)
+	if err != nil {
+		return nil, fmt.Errorf("invalid proxy upstream %q: %v", upstream, err)
+	}
+	supported := false
+	for _, scheme := range schemes {
+		supported = supported || u.Scheme == scheme
+	}
+	if !supported {
+		return nil, fmt.Errorf("unsupported proxy upstream scheme %q, must be %s", u.Scheme, strings.Join(schemes, " or "))
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("invalid proxy upstream %q: no host", upstream)
+	}
+	return u, nil
+}
+
+// getUpstream parses the upstream option of a network, nil if the network
+// goes through tor the way the plugin was started with. Otherwise its
+// connections are relayed through the SOCKS5 or HTTP CONNECT proxy at the
+// URL.
+func getUpstream(opts map[string]interface{}) (*url.URL, error) {
+	v, ok := getOption(opts, upstreamOption)
+	if !ok || v == "" || v == "tor" {
+		return nil, nil
+	}
+	u, err := parseProxyUpstream(v, "socks5", "http")
+	if err != nil {
+		return nil, fmt.Errorf("Invalid %s: %v", upstreamOption, err)
+	}
+	return u, nil
+}
+
+// proxyDialer returns the dialer for the upstream proxy, authenticating
+// with auth or, without it, with the credentials of the URL.
+func proxyDialer(upstream *url.URL, auth *proxy.Auth) (proxy.Dialer, error) {
+	forward := &net.Dialer{Timeout: proxyDialTimeout}
+	if auth == nil && upstream.User != nil {
+		password, _ := upstream.User.Password()
+		auth = &proxy.Auth{User: upstream.User.Username(), Password: password}
+	}
+
+	switch upstream.Scheme {
+	case "socks5":
+		return proxy.SOCKS5("tcp", upstream.Host, auth, forward)
+	case "http":
+		return &httpConnectDialer{addr: upstream.Host, auth: auth, forward: forward, timeout: proxyDialTimeout}, nil
+	}
+	return nil, fmt.Errorf("unsupported proxy upstream scheme %q", upstream.Scheme)
+}
+
+// transparentProxy accepts the connections redirected from the containers
+// of a network and relays them to their original destination through the
+// upstream proxy.
+type transparentProxy struct {
+	listener  *net.TCPListener
+	upstream  *url.URL
+	networkID string
+	// isolate sends the isolation group of each connection to tor as the
+	// SOCKS credentials
+	isolate bool
+	// group returns the isolation group of the container with the address
+	group func(net.IP) string
+	// i2p maps the virtual addresses of the .i2p names back to them, the
+	// connections to those are relayed through i2pUpstream
+	i2p         *i2pAddrMap
+	i2pUpstream *url.URL
+	// hosts, if set, decides which hostnames the connections may be for
+	hosts *domainPolicy
+	// audit, if set, is called with every connection once it is done
+	audit func(src net.IP, dst, hostname string, start time.Time, sent, received int64, err error)
+	// account, if set, returns the counter of the bytes the connection of
+	// the container with the address relays
+	account func(src net.IP) *usageCounter
+	// streams, if set, holds the connection of the container with the
+	// address back while it is over its limits
+	streams func(src net.IP) (*stream, error)
+}
+
+// listen starts accepting the redirected connections on the address.
+func (p *transparentProxy) listen(listen string) error {
+	addr, err := net.ResolveTCPAddr("tcp", listen)
+	if err != nil {
+		return err
+	}
+	p.listener, err = net.ListenTCP("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("listening for redirected connections on %s failed: %v", listen, err)
+	}
+
+	go p.serve()
+	return nil
+}
+
+// Close stops the proxy from accepting connections, the ones it is relaying
+// go on until either side closes them.
+func (p *transparentProxy) Close() error {
+	return p.listener.Close()
+}
+
+func (p *transparentProxy) serve() {
+	for {
+		conn, err := p.listener.AcceptTCP()
+		if err != nil {
+			if strings.Contains(err.Error(), "use of closed network connection") {
+				return
+			}
+			logrus.Warnf("Accepting redirected connection failed: %v", err)
+			continue
+		}
+		go p.handle(conn)
+	}
+}
+
+func (p *transparentProxy) handle(conn *net.TCPConn) {
+	defer conn.Close()
+
+	dst, err := originalDst(conn)
+	if err != nil {
+		logrus.Warnf("Getting the original destination of the connection from %s failed: %v", conn.RemoteAddr(), err)
+		return
+	}
+
+	src := conn.RemoteAddr().(*net.TCPAddr).IP
+	start := time.Now()
+
+	target := dst.String()
+	if p.i2p != nil && p.i2p.virtualNet.Contains(dst.IP) {
+		name := p.i2p.name(dst.IP)
+		if name == "" {
+			logrus.Debugf("Resetting the connection from %s to %s, no .i2p name is mapped to it", src, dst)
+			conn.SetLinger(0)
+			return
+		}
+		target = net.JoinHostPort(name, strconv.Itoa(dst.Port))
+	}
+
+	var s *stream
+	if p.streams != nil {
+		s, err = p.streams(src)
+		if err != nil {
+			logrus.Debugf("Resetting the connection from %s to %s: %v", src, target, err)
+			conn.SetLinger(0)
+			if p.audit != nil {
+				p.audit(src, target, "", start, 0, 0, err)
+			}
+			return
+		}
+		defer s.release()
+	}
+
+	var (
+		client   net.Conn = conn
+		hostname string
+	)
+	if p.hosts != nil {
+		var allowed bool
+		client, hostname, allowed = p.checkHostname(conn)
+		if !allowed {
+			logrus.Debugf("Resetting the connection from %s to %s for hostname %q", src, target, hostname)
+			// closing without lingering resets the connection
+			conn.SetLinger(0)
+			if p.audit != nil {
+				p.audit(src, target, hostname, start, 0, 0, errHostnameNotAllowed)
+			}
+			return
+		}
+		target = hostTarget(dst, target, hostname)
+	}
+
+	var usage *usageCounter
+	if p.account != nil {
+		usage = p.account(src)
+	}
+	if usage != nil {
+		client = &countingConn{Conn: client, usage: usage}
+	}
+
+	var idleTimeout time.Duration
+	if s != nil {
+		idleTimeout = s.idleTimeout
+	}
+	sent, received, err := p.forward(client, target, p.group(src), idleTimeout)
+	if err == errIdleTimeout {
+		streamsIdleTimedOut.Add(s.key, 1)
+	}
+	if p.audit != nil {
+		p.audit(src, target, hostname, start, sent, received, err)
+	}
+	// the bytes were counted as they were relayed
+	if usage != nil && (err == nil || err == errIdleTimeout) {
+		usage.add(1, 0, 0)
+	}
+}
+
+// hostTarget returns where to relay a connection the host policy allowed
+// for the hostname to. That is the hostname itself, for the upstream to
+// resolve, rather than the address the container connected to, which could
+// be of a front that serves other hosts than the one that was allowed.
+// Connections without a hostname and to .i2p names go where they were for.
+func hostTarget(dst *net.TCPAddr, target, hostname string) string {
+	if hostname == "" || target != dst.String() {
+		return target
+	}
+	return net.JoinHostPort(hostname, strconv.Itoa(dst.Port))
+}
+
+// checkHostname finds the hostname the connection is for and returns
+// whether the host policy allows it, with the connection to relay, which
+// still starts with what was read.
+func (p *transparentProxy) checkHostname(conn net.Conn) (net.Conn, string, bool) {
+	hostname, peeked := peekHostname(conn)
+	return newPeekedConn(conn, peeked), hostname, p.hosts.permit(hostname)
+}
+
+// forward relays the connection to the destination through the upstream
+// proxy, on the circuits of the isolation group, or to a .i2p destination
+// through I2P, closing it once it was idle for the timeout if there is one.
+// It returns the bytes sent to and received from the destination.
+func (p *transparentProxy) forward(conn net.Conn, dst, group string, idleTimeout time.Duration) (int64, int64, error) {
+	via, auth := p.upstream, p.credentials(group)
+	if host, _, _ := net.SplitHostPort(dst); isI2PName(host) {
+		via, auth = p.i2pUpstream, nil
+	}
+	if via == nil {
+		return 0, 0, fmt.Errorf("no upstream to relay the connection to %s through", dst)
+	}
+
+	dialer, err := proxyDialer(via, auth)
+	if err != nil {
+		logrus.Warnf("Creating the dialer for the proxy upstream failed: %v", err)
+		return 0, 0, err
+	}
+	upstream, err := dialer.Dial("tcp", dst)
+	if err != nil {
+		logrus.Debugf("Connecting %s to %s through the proxy failed: %v", conn.RemoteAddr(), dst, err)
+		return 0, 0, err
+	}
+	defer upstream.Close()
+
+	if idleTimeout > 0 {
+		idle := newIdleTimer(idleTimeout, conn, upstream)
+		defer idle.stop()
+		sent, received := relay(idle.wrap(conn), idle.wrap(upstream))
+		if idle.timedOut() {
+			return sent, received, errIdleTimeout
+		}
+		return sent, received, nil
+	}
+
+	sent, received := relay(conn, upstream)
+	return sent, received, nil
+}
+
+// credentials returns the SOCKS credentials of the connections of the
+// isolation group. Unless the URL of the upstream has credentials of its
+// own, tor's IsolateSOCKSAuth keeps the groups on separate circuits with
+// the network and the group as the username and password.
+func (p *transparentProxy) credentials(group string) *proxy.Auth {
+	if !p.isolate || p.upstream == nil || p.upstream.User != nil {
+		return nil
+	}
+	return &proxy.Auth{User: "onion:" + p.networkID, Password: group}
+}
+
+// originalDst returns the destination of the redirected connection.
+func originalDst(conn *net.TCPConn) (*net.TCPAddr, error) {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		addr *unix.IPv6Mreq
+		serr error
+	)
+	if err := raw.Control(func(fd uintptr) {
+		// the option fills in a sockaddr_in, which fits in the
+		// multiaddr of an ipv6_mreq
+		addr, serr = unix.GetsockoptIPv6Mreq(int(fd), unix.SOL_IP, soOriginalDst)
+	}); err != nil {
+		return nil, err
+	}
+	if serr != nil {
+		return nil, serr
+	}
+
+	b := addr.Multiaddr
+	return &net.TCPAddr{
+		IP:   net.IPv4(b[4], b[5], b[6], b[7]),
+		Port: int(b[2])<<8 | int(b[3]),
+	}, nil
+}
+
+// relay copies between the connections until both directions are done,
+// returning the bytes copied from the client and from the upstream.
+func relay(client, upstream net.Conn) (int64, int64) {
+	var sent int64
+	done := make(chan struct{})
+	go func() {
+		sent, _ = io.Copy(upstream, client)
+		closeWrite(upstream)
+		close(done)
+	}()
+	received, _ := io.Copy(client, upstream)
+	closeWrite(client)
+	<-done
+	return sent, received
+}
+
+// closeWrite signals the end of the data to the other side, closing the
+// connection outright if it cannot be half-closed.
+func closeWrite(conn net.Conn) {
+	if c, ok := conn.(interface {
+		CloseWrite() error
+	}); ok {
+		c.CloseWrite()
+		return
+	}
+	conn.Close()
+}
+
+// startProxy starts the transparent proxy of the network, if the plugin
+// relays its connections itself or it reaches I2P.
+func (n *NetworkState) startProxy() error {
+	if n.proxyUpstream == nil && n.i2pAddrs == nil {
+		return nil
+	}
+
+	p := &transparentProxy{
+		upstream:    n.proxyUpstream,
+		networkID:   n.id,
+		isolate:     n.proxyUpstream != nil && n.proxyUpstream == n.torUpstream,
+		group:       n.isolationGroupByIP,
+		i2p:         n.i2pAddrs,
+		i2pUpstream: n.i2pUpstream,
+		hosts:       n.hostPolicy,
+	}
+	if n.audit != nil {
+		p.audit = n.auditConnection
+	}
+	if n.accounting != nil {
+		p.account = n.accountConnection
+	}
+	if n.streams != nil {
+		p.streams = n.acquireStream
+	}
+	if err := p.listen(n.host.listenAddr("proxy", net.JoinHostPort(n.Gateway, proxyPort))); err != nil {
+		return err
+	}
+	n.proxy = p
+	return nil
+}
+
+// stopProxy stops the transparent proxy of the network, if it has one.
+func (n *NetworkState) stopProxy() error {
+	if n.proxy == nil {
+		return nil
+	}
+	return n.proxy.Close()
+}
@@ -0,0 +1,203 @@
+package tor
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+// fakeSOCKS5 is a SOCKS5 server that connects to the targets directly and
+// remembers what it was asked for. It answers tor's RESOLVE and RESOLVE_PTR
+// from names and addrs.
+type fakeSOCKS5 struct {
+	listener net.Listener
+	names    map[string]net.IP
+	addrs    map[string]string
+	sync.Mutex
+	users    []string
+	targets  []string
+	resolves []string
+}
+
+func newFakeSOCKS5(t *testing.T) *fakeSOCKS5 {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &fakeSOCKS5{listener: l}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go s.handle(conn)
+		}
+	}()
+	return s
+}
+
+func (s *fakeSOCKS5) handle(conn net.Conn) {
+	defer conn.Close()
+
+	// greeting, pick username and password if offered
+	b := make([]byte, 262)
+	if _, err := io.ReadFull(conn, b[:2]); err != nil {
+		return
+	}
+	methods := b[2 : 2+int(b[1])]
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return
+	}
+	method := byte(0)
+	for _, m := range methods {
+		if m == 2 {
+			method = 2
+		}
+	}
+	conn.Write([]byte{5, method})
+
+	user := ""
+	if method == 2 {
+		if _, err := io.ReadFull(conn, b[:2]); err != nil {
+			return
+		}
+		u := make([]byte, b[1])
+		io.ReadFull(conn, u)
+		io.ReadFull(conn, b[:1])
+		p := make([]byte, b[0])
+		io.ReadFull(conn, p)
+		user = string(u) + ":" + string(p)
+		conn.Write([]byte{1, 0})
+	}
+
+	// request
+	if _, err := io.ReadFull(conn, b[:4]); err != nil {
+		return
+	}
+	cmd := b[1]
+	var host string
+	switch b[3] {
+	case 1:
+		io.ReadFull(conn, b[:4])
+		host = net.IP(b[:4]).String()
+	case 3:
+		io.ReadFull(conn, b[:1])
+		name := make([]byte, b[0])
+		io.ReadFull(conn, name)
+		host = string(name)
+	}
+	io.ReadFull(conn, b[:2])
+	target := net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(b[:2]))))
+
+	s.Lock()
+	s.users = append(s.users, user)
+	if cmd != 1 {
+		s.resolves = append(s.resolves, host)
+	} else {
+		s.targets = append(s.targets, target)
+	}
+	s.Unlock()
+
+	switch cmd {
+	case socksCmdResolve:
+		if ip, ok := s.names[host]; ok {
+			conn.Write(append(append([]byte{5, 0, 0, 1}, ip.To4()...), 0, 0))
+			return
+		}
+		conn.Write([]byte{5, socksHostUnreachable, 0, 1, 0, 0, 0, 0, 0, 0})
+		return
+	case socksCmdResolvePTR:
+		if name, ok := s.addrs[host]; ok {
+			conn.Write(append(append([]byte{5, 0, 0, 3, byte(len(name))}, name...), 0, 0))
+			return
+		}
+		conn.Write([]byte{5, socksHostUnreachable, 0, 1, 0, 0, 0, 0, 0, 0})
+		return
+	}
+
+	upstream, err := net.Dial("tcp", target)
+	if err != nil {
+		conn.Write([]byte{5, 5, 0, 1, 0, 0, 0, 0, 0, 0})
+		return
+	}
+	defer upstream.Close()
+	conn.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+
+	relay(conn, upstream)
+}
+
+// echoServer echoes back what it reads on every connection.
+func echoServer(t *testing.T) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(conn, conn)
+				conn.Close()
+			}()
+		}
+	}()
+	return l
+}
+
+func TestParseProxyUpstream(t *testing.T) {
+	if _, err := parseProxyUpstream("socks5://127.0.0.1:9050", "socks5"); err != nil {
+		t.Fatal(err)
+	}
+	for _, upstream := range []string{"http://127.0.0.1:8080", "127.0.0.1:9050", "socks5://"} {
+		if _, err := parseProxyUpstream(upstream, "socks5"); err == nil {
+			t.Errorf("expected error for upstream %q", upstream)
+		}
+	}
+}
+
+func TestTransparentProxyForward(t *testing.T) {
+	socks := newFakeSOCKS5(t)
+	defer socks.listener.Close()
+	echo := echoServer(t)
+	defer echo.Close()
+
+	upstream, err := parseProxyUpstream("socks5://"+socks.listener.Addr().String(), "socks5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &transparentProxy{upstream: upstream, networkID: "0123456789abcdef", isolate: true}
+
+	client, conn := net.Pipe()
+	go func() {
+		p.forward(conn, echo.Addr().String(), "endpoint:fedcba9876543210", 0)
+		conn.Close()
+	}()
+
+	if _, err := client.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	b := make([]byte, 4)
+	if _, err := io.ReadFull(client, b); err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "ping" {
+		t.Fatalf("expected ping back, got %q", b)
+	}
+	client.Close()
+
+	socks.Lock()
+	defer socks.Unlock()
+	if len(socks.targets) != 1 || socks.targets[0] != echo.Addr().String() {
+		t.Fatalf("expected the proxy to connect to %s, got %v", echo.Addr(), socks.targets)
+	}
+	if expected := "onion:0123456789abcdef:endpoint:fedcba9876543210"; socks.users[0] != expected {
+		t.Fatalf("expected the credentials %q, got %q", expected, socks.users[0])
+	}
+}
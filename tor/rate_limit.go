@@ -0,0 +1,162 @@
+package tor
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	rateLimitCommentPrefix = "onion-ratelimit-"
+	counterInterval        = 10 * time.Second
+)
+
+// rateLimit is the number of new tcp connections a second an endpoint may
+// open through tor, with bursts up to burst. A zero rate is no limit.
+type rateLimit struct {
+	rate  int
+	burst int
+}
+
+// getRateLimit parses the rate limit options, of a network or of an
+// endpoint, falling back to def for what is not set. The burst defaults to
+// the rate.
+func getRateLimit(opts map[string]interface{}, def rateLimit) (rateLimit, error) {
+	l := def
+	if v, ok := getOption(opts, rateLimitOption); ok && v != "" {
+		rate, err := strconv.Atoi(v)
+		if err != nil || rate < 0 {
+			return l, fmt.Errorf("Invalid %s %q", rateLimitOption, v)
+		}
+		l = rateLimit{rate: rate, burst: rate}
+	}
+	if v, ok := getOption(opts, rateLimitBurstOption); ok && v != "" {
+		burst, err := strconv.Atoi(v)
+		if err != nil || burst < 1 {
+			return l, fmt.Errorf("Invalid %s %q", rateLimitBurstOption, v)
+		}
+		l.burst = burst
+	}
+	return l, nil
+}
+
+// endpointRateLimit is the rate limit of an endpoint on the network.
+type endpointRateLimit struct {
+	id   string
+	addr *net.IPNet
+	rateLimit
+}
+
+// rateLimitComment is the comment of the rate limiting rule of an endpoint.
+func rateLimitComment(endpointID string) string {
+	return rateLimitCommentPrefix + endpointID
+}
+
+// endpointRateLimits returns the rate limits of the endpoints. The caller
+// holds the lock of the network.
+func (n *NetworkState) endpointRateLimits() []endpointRateLimit {
+	var limits []endpointRateLimit
+	for id, ep := range n.endpoints {
+		if ep.addr == nil || ep.rateLimit.rate == 0 {
+			continue
+		}
+		limits = append(limits, endpointRateLimit{id: id, addr: ep.addr, rateLimit: ep.rateLimit})
+	}
+	return limits
+}
+
+// rateLimitName is the name of the hashlimit bucket of an endpoint, which
+// can be at most 15 characters long.
+func rateLimitName(prefix, endpointID string) string {
+	name := prefix + endpointID
+	if len(name) > 15 {
+		name = name[:15]
+	}
+	return name
+}
+
+// limitConnections drops the new connections into tor of each endpoint
+// above its rate, and those to .i2p names the transparent proxy relays when
+// the rest goes to tor's TransPort, at the same rate on their own. The
+// rules have to come ahead of the rules letting the containers reach the
+// tor ports.
+func (fc *firewallConfig) limitConnections() []firewallRule {
+	var rules []firewallRule
+	for _, l := range fc.rateLimits {
+		rules = append(rules, firewallRule{table: "filter", chain: "INPUT", in: fc.bridgeName,
+			src: l.addr.IP.String(), proto: "tcp", dport: fc.transPort, syn: true,
+			rateAbove: l.rate, rateBurst: l.burst, rateName: rateLimitName("onion-", l.id),
+			comment: rateLimitComment(l.id), target: "DROP"})
+		if fc.i2pNet != "" && fc.transPort != proxyPort {
+			rules = append(rules, firewallRule{table: "filter", chain: "INPUT", in: fc.bridgeName,
+				src: l.addr.IP.String(), proto: "tcp", dport: proxyPort, syn: true,
+				rateAbove: l.rate, rateBurst: l.burst, rateName: rateLimitName("oni2p-", l.id),
+				comment: rateLimitComment(l.id), target: "DROP"})
+		}
+	}
+	return rules
+}
+
+// collectCounters periodically adds what the firewall rules of the networks
+// matched to the metrics, and saves the accounting of the endpoints.
+func (d *Driver) collectCounters(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		d.Lock()
+		networks := make([]*NetworkState, 0, len(d.networks))
+		for _, ns := range d.networks {
+			networks = append(networks, ns)
+		}
+		d.Unlock()
+
+		for _, ns := range networks {
+			ns.Lock()
+			ns.collectCounters()
+			ns.Unlock()
+		}
+
+		if err := d.accounting.save(); err != nil {
+			logrus.Warnf("Saving the accounting file failed: %v", err)
+		}
+	}
+}
+
+// collectCounters adds what the rules matched since they were last read to
+// the metrics. The caller holds the lock of the network.
+func (n *NetworkState) collectCounters() {
+	// the network is still being set up
+	if n.rules == nil {
+		return
+	}
+
+	counters, err := n.firewall.counters(n)
+	if err != nil {
+		logrus.Warnf("Reading firewall counters for bridge %s failed: %v", n.BridgeName, err)
+		return
+	}
+
+	if n.counters == nil {
+		n.counters = map[string]uint64{}
+	}
+	for comment, packets := range counters {
+		delta := packets - n.counters[comment]
+		if packets < n.counters[comment] {
+			// the rules were programmed again by someone else
+			delta = packets
+		}
+		n.counters[comment] = packets
+		if delta == 0 {
+			continue
+		}
+
+		if strings.HasPrefix(comment, rateLimitCommentPrefix) {
+			rateLimited.Add(strings.TrimPrefix(comment, rateLimitCommentPrefix), int64(delta))
+		}
+	}
+}
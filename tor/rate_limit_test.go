@@ -0,0 +1,217 @@
+package tor
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/docker/docker/api/types"
+	dockernetwork "github.com/docker/docker/api/types/network"
+	"github.com/docker/go-plugins-helpers/network"
+)
+
+func TestGetRateLimit(t *testing.T) {
+	def, err := getRateLimit(map[string]interface{}{rateLimitOption: "10"}, rateLimit{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if def != (rateLimit{rate: 10, burst: 10}) {
+		t.Fatalf("expected a rate of 10 with bursts of 10, got %+v", def)
+	}
+
+	// the endpoint options override the network's
+	l, err := getRateLimit(map[string]interface{}{rateLimitBurstOption: "50"}, def)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l != (rateLimit{rate: 10, burst: 50}) {
+		t.Fatalf("expected a rate of 10 with bursts of 50, got %+v", l)
+	}
+	l, err = getRateLimit(map[string]interface{}{rateLimitOption: "0"}, def)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l.rate != 0 {
+		t.Fatalf("expected no rate limit, got %+v", l)
+	}
+
+	for _, v := range []string{"-1", "fast"} {
+		if _, err := getRateLimit(map[string]interface{}{rateLimitOption: v}, def); err == nil {
+			t.Errorf("expected error parsing %q", v)
+		}
+	}
+}
+
+func TestRateLimitRule(t *testing.T) {
+	d, dr, _ := newDryRunDriver(t, false)
+	if err := d.CreateNetwork(&network.CreateNetworkRequest{
+		NetworkID: "0123456789abcdef",
+		Options:   map[string]interface{}{rateLimitOption: "5"},
+		IPv4Data:  []*network.IPAMData{{Gateway: "172.18.0.1/16"}},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	defer d.DeleteNetwork(&network.DeleteNetworkRequest{NetworkID: "0123456789abcdef"})
+
+	if _, err := d.CreateEndpoint(&network.CreateEndpointRequest{
+		NetworkID:  "0123456789abcdef",
+		EndpointID: "fedcba9876543210",
+		Interface:  &network.EndpointInterface{Address: "172.18.0.2/16"},
+		Options:    map[string]interface{}{rateLimitBurstOption: "20"},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	rule := "-t filter -A INPUT -i torbr-01234 -s 172.18.0.2 -p tcp --dport 22340 --syn " +
+		"-m hashlimit --hashlimit-above 5/sec --hashlimit-burst 20 --hashlimit-name onion-fedcba987 " +
+		"-m comment --comment onion-ratelimit-fedcba9876543210 -j DROP"
+	var found bool
+	for _, r := range dr.rules["torbr-01234"] {
+		found = found || r.String() == rule
+	}
+	if !found {
+		t.Fatalf("expected rule %q to be programmed", rule)
+	}
+
+	if err := d.DeleteEndpoint(&network.DeleteEndpointRequest{
+		NetworkID:  "0123456789abcdef",
+		EndpointID: "fedcba9876543210",
+	}); err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range dr.rules["torbr-01234"] {
+		if r.comment != "" {
+			t.Fatalf("expected the rate limit to be removed, got %s", r)
+		}
+	}
+
+	// the flows of the other containers are left alone
+	var flushes int
+	for _, c := range dr.changes {
+		if c.Action == "flush" && c.Object == "conntrack" {
+			flushes++
+		}
+	}
+	if flushes != 1 {
+		t.Fatalf("expected conntrack to be flushed only when the network was created, got %d flushes", flushes)
+	}
+}
+
+func TestVerifyRateLimitedEndpoint(t *testing.T) {
+	d, dr, _ := newDryRunDriver(t, false)
+	if err := d.CreateNetwork(&network.CreateNetworkRequest{
+		NetworkID: "0123456789abcdef",
+		Options:   map[string]interface{}{rateLimitOption: "5"},
+		IPv4Data:  []*network.IPAMData{{Gateway: "172.18.0.1/16"}},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	defer d.DeleteNetwork(&network.DeleteNetworkRequest{NetworkID: "0123456789abcdef"})
+	if _, err := d.CreateEndpoint(&network.CreateEndpointRequest{
+		NetworkID:  "0123456789abcdef",
+		EndpointID: "fedcba9876543210",
+		Interface:  &network.EndpointInterface{Address: "172.18.0.2/16"},
+		Options:    map[string]interface{}{rateLimitBurstOption: "20"},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// what is programmed in the INPUT chain, as the backends list it
+	var comments []string
+	for _, r := range dr.rules["torbr-01234"] {
+		if r.chain == "INPUT" {
+			comments = append(comments, iptablesComment("-A TOR-IN-torbr-01234 "+iptablesScriptArgs(r.iptablesTagged())))
+		}
+	}
+
+	// verify rebuilds the network without its endpoints
+	ns, err := d.networkStateFromResource(types.NetworkResource{
+		ID:      "0123456789abcdef",
+		Options: map[string]string{rateLimitOption: "5"},
+		IPAM:    dockernetwork.IPAM{Config: []dockernetwork.IPAMConfig{{Subnet: "172.18.0.0/16", Gateway: "172.18.0.1"}}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fc, err := ns.firewallConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var expected []firewallRule
+	for _, r := range fc.rules() {
+		if r.chain == "INPUT" {
+			expected = append(expected, r)
+		}
+	}
+
+	tag := func(r firewallRule) (string, error) {
+		return ruleTag(strings.Join(r.iptablesArgs(), " ")), nil
+	}
+	drifted, err := ns.driftedRules(expected, comments, tag)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(drifted) != 0 {
+		t.Fatalf("expected the rules of the rate limited endpoint to be left out, got %v", drifted)
+	}
+
+	// anything else in the chain is still drift
+	drifted, err = ns.driftedRules(expected, append([]string{""}, comments...), tag)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(drifted) == 0 {
+		t.Fatal("expected a rule added to the chain to be drift")
+	}
+}
+
+func TestRateLimitI2P(t *testing.T) {
+	_, addr, _ := net.ParseCIDR("172.18.0.0/16")
+	fc := &firewallConfig{
+		bridgeName: "torbr-1",
+		transPort:  torTransparentProxyPort,
+		addr:       addr,
+		i2pNet:     defaultI2PVirtualAddrNetwork,
+		rateLimits: []endpointRateLimit{{id: "fedcba9876543210", addr: &net.IPNet{IP: net.IPv4(172, 18, 0, 2)}, rateLimit: rateLimit{rate: 5, burst: 5}}},
+	}
+
+	ports := map[string]string{}
+	for _, r := range fc.limitConnections() {
+		ports[r.dport] = r.rateName
+	}
+	if ports[torTransparentProxyPort] != "onion-fedcba987" || ports[proxyPort] != "oni2p-fedcba987" {
+		t.Fatalf("expected the connections to tor and to I2P to be limited, got %v", ports)
+	}
+}
+
+func TestFirewallCounters(t *testing.T) {
+	iptablesOutput := `-N TOR-IN-torbr-1
+-A TOR-IN-torbr-1 -i torbr-1 -m conntrack --ctstate RELATED,ESTABLISHED -c 120 9000 -j ACCEPT
+-A TOR-IN-torbr-1 -s 172.18.0.2/32 -i torbr-1 -p tcp -m tcp --dport 22340 --tcp-flags FIN,SYN,RST,ACK SYN -m hashlimit --hashlimit-above 5/sec --hashlimit-burst 20 --hashlimit-name onion-fedcba987 -m comment --comment onion-ratelimit-ep1 -c 7 420 -j DROP
+`
+	counters := iptablesCounters(iptablesOutput)
+	if len(counters) != 1 || counters["onion-ratelimit-ep1"] != 7 {
+		t.Fatalf("expected 7 packets for onion-ratelimit-ep1, got %v", counters)
+	}
+
+	nftOutput := `table ip onion_torbr_1 {
+	chain input {
+		type filter hook input priority filter; policy accept;
+		iifname "torbr-1" ip saddr 172.18.0.2 tcp dport 22340 tcp flags & (fin | syn | rst | ack) == syn limit rate over 5/second burst 20 packets counter packets 3 bytes 180 drop comment "onion-ratelimit-ep1"
+	}
+}
+`
+	counters = nftCounters(nftOutput)
+	if len(counters) != 1 || counters["onion-ratelimit-ep1"] != 3 {
+		t.Fatalf("expected 3 packets for onion-ratelimit-ep1, got %v", counters)
+	}
+
+	expr, err := firewallRule{table: "filter", chain: "INPUT", in: "torbr-1", proto: "tcp", dport: "22340",
+		rateAbove: 5, rateBurst: 20, comment: "onion-ratelimit-ep1", target: "DROP"}.nftExpr()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasSuffix(expr, `limit rate over 5/second burst 20 packets counter drop comment "onion-ratelimit-ep1"`) {
+		t.Fatalf("unexpected nft expression %q", expr)
+	}
+}
@@ -0,0 +1,114 @@
+package tor
+
+import (
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// reconcile periodically compares the firewall rules of each network with
+// what is programmed on the host. Something else on the host, like a
+// firewalld reload or an `iptables -F`, can wipe the rules and leave a
+// network leaking, so missing rules are programmed again. If that fails, or
+// failClosed is set, the bridge is taken down instead, and brought back up
+// once the rules could be programmed again.
+func (d *Driver) reconcile(interval time.Duration, failClosed bool) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		d.Lock()
+		networks := make(map[string]*NetworkState, len(d.networks))
+		for id, ns := range d.networks {
+			networks[id] = ns
+		}
+		d.Unlock()
+
+		for id, ns := range networks {
+			ns.reconcileFirewall(id, failClosed)
+		}
+	}
+}
+
+func (n *NetworkState) reconcileFirewall(id string, failClosed bool) {
+	n.Lock()
+	defer n.Unlock()
+
+	// the network is still being set up
+	if n.rules == nil {
+		return
+	}
+
+	if n.failedClosed {
+		n.recoverFirewall(id)
+		return
+	}
+
+	missing, err := n.firewall.check(n, n.rules)
+	if err != nil {
+		logrus.Warnf("Checking firewall rules for bridge %s failed: %v", n.BridgeName, err)
+		return
+	}
+	if len(missing) == 0 {
+		return
+	}
+
+	firewallDrift.Add(id, 1)
+	logger := logrus.WithFields(logrus.Fields{
+		"network": id,
+		"bridge":  n.BridgeName,
+		"missing": len(missing),
+	})
+	for _, r := range missing {
+		logger.Debugf("Missing firewall rule: %s", r)
+	}
+
+	if !failClosed {
+		logger.Warn("Firewall rules drifted, programming them again")
+		if err = n.programFirewall(n.rules); err == nil {
+			// flows set up while the rules were missing went around tor
+			if err := n.host.flushConntrack(n.subnet); err != nil {
+				logger.Warnf("Failed to flush conntrack entries: %v", err)
+			}
+			return
+		}
+		logger.Errorf("Programming firewall rules again failed: %v", err)
+	}
+
+	logger.Error("Firewall rules drifted, taking the bridge down")
+	if err := n.host.setLinkDown(n.BridgeName); err != nil {
+		logger.Errorf("Taking the bridge down failed: %v", err)
+		return
+	}
+	n.failedClosed = true
+}
+
+// recoverFirewall programs the rules of a network whose bridge was taken
+// down again and brings the bridge back up once they are in place.
+func (n *NetworkState) recoverFirewall(id string) {
+	logger := logrus.WithFields(logrus.Fields{
+		"network": id,
+		"bridge":  n.BridgeName,
+	})
+
+	if err := n.programFirewall(n.rules); err != nil {
+		logger.Debugf("Programming firewall rules again failed, leaving the bridge down: %v", err)
+		return
+	}
+	missing, err := n.firewall.check(n, n.rules)
+	if err != nil || len(missing) > 0 {
+		logger.Debugf("Firewall rules are still not in place, leaving the bridge down: %v", err)
+		return
+	}
+	// nothing could get out while the bridge was down, but flows set up
+	// before it was taken down went around tor
+	if err := n.host.flushConntrack(n.subnet); err != nil {
+		logger.Warnf("Failed to flush conntrack entries: %v", err)
+	}
+	if err := n.host.setLinkUp(n.BridgeName); err != nil {
+		logger.Errorf("Bringing the bridge back up failed: %v", err)
+		return
+	}
+	n.failedClosed = false
+	logger.Info("Firewall rules programmed again, brought the bridge back up")
+}
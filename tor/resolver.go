@@ -0,0 +1,349 @@
+package tor
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// tor's SOCKS extensions resolving a name and an address
+	socksCmdResolve    = 0xf0
+	socksCmdResolvePTR = 0xf1
+	// socksHostUnreachable is what tor replies when resolving failed
+	socksHostUnreachable = 4
+
+	dnsTypeA    = 1
+	dnsTypePTR  = 12
+	dnsTypeAAAA = 28
+
+	dnsRcodeServFail = 2
+	dnsRcodeNotImp   = 4
+
+	// tor does not pass on the ttl of the records
+	resolverTTL       = 60 * time.Second
+	resolverCacheSize = 4096
+)
+
+// socksReplyError is the failure a SOCKS server replied with.
+type socksReplyError byte
+
+func (e socksReplyError) Error() string {
+	return fmt.Sprintf("socks request failed with reply %d", byte(e))
+}
+
+// socksCommand sends the command for the address, of the SOCKS address
+// type, to the upstream and returns the address type and the address of the
+// reply.
+func socksCommand(upstream *url.URL, user, password string, cmd, atyp byte, addr []byte) (byte, []byte, error) {
+	conn, err := net.DialTimeout("tcp", upstream.Host, dnsTimeout)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(dnsTimeout))
+
+	b := make([]byte, 256)
+	if _, err := conn.Write([]byte{5, 1, 2}); err != nil {
+		return 0, nil, err
+	}
+	if _, err := io.ReadFull(conn, b[:2]); err != nil {
+		return 0, nil, err
+	}
+	switch b[1] {
+	case 0:
+	case 2:
+		auth := append([]byte{1, byte(len(user))}, user...)
+		auth = append(append(auth, byte(len(password))), password...)
+		if _, err := conn.Write(auth); err != nil {
+			return 0, nil, err
+		}
+		if _, err := io.ReadFull(conn, b[:2]); err != nil {
+			return 0, nil, err
+		}
+		if b[1] != 0 {
+			return 0, nil, fmt.Errorf("socks authentication failed")
+		}
+	default:
+		return 0, nil, fmt.Errorf("socks server refused the authentication methods")
+	}
+
+	req := append([]byte{5, cmd, 0, atyp}, addr...)
+	if _, err := conn.Write(append(req, 0, 0)); err != nil {
+		return 0, nil, err
+	}
+
+	if _, err := io.ReadFull(conn, b[:4]); err != nil {
+		return 0, nil, err
+	}
+	if b[1] != 0 {
+		return 0, nil, socksReplyError(b[1])
+	}
+	atyp = b[3]
+	var l int
+	switch atyp {
+	case 1:
+		l = net.IPv4len
+	case 4:
+		l = net.IPv6len
+	case 3:
+		if _, err := io.ReadFull(conn, b[:1]); err != nil {
+			return 0, nil, err
+		}
+		l = int(b[0])
+	default:
+		return 0, nil, fmt.Errorf("socks reply has unknown address type %d", atyp)
+	}
+	reply := make([]byte, l+2)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return 0, nil, err
+	}
+	return atyp, reply[:l], nil
+}
+
+// resolverEntry is a cached answer.
+type resolverEntry struct {
+	ip      net.IP
+	name    string
+	rcode   byte
+	expires time.Time
+}
+
+// socksResolver answers A, AAAA and PTR queries with tor's SOCKS RESOLVE
+// and RESOLVE_PTR extensions, caching the answers. The .onion names
+// resolved to tor's virtual addresses are cached too, for the reverse
+// lookups of those addresses.
+type socksResolver struct {
+	upstream   *url.URL
+	networkID  string
+	virtualNet *net.IPNet
+
+	sync.Mutex
+	cache map[string]resolverEntry
+}
+
+func newSOCKSResolver(upstream *url.URL, networkID string, virtualNet *net.IPNet) *socksResolver {
+	return &socksResolver{
+		upstream:   upstream,
+		networkID:  networkID,
+		virtualNet: virtualNet,
+		cache:      map[string]resolverEntry{},
+	}
+}
+
+// answer returns the reply to the query. Anything but A, AAAA and PTR
+// queries is answered with NOTIMP, like tor's DNSPort does.
+func (r *socksResolver) answer(query []byte, name string, qtype uint16, end int) []byte {
+	switch qtype {
+	case dnsTypeA, dnsTypeAAAA:
+		e := r.lookup("name:"+name, func() (resolverEntry, error) {
+			return r.resolve(name)
+		})
+		if e.rcode != 0 {
+			return dnsErrorReply(query, end, e.rcode)
+		}
+		if qtype == dnsTypeA && e.ip.To4() != nil {
+			return dnsAnswerReply(query, end, qtype, e.ttl(), e.ip.To4())
+		}
+		if qtype == dnsTypeAAAA && e.ip.To4() == nil {
+			return dnsAnswerReply(query, end, qtype, e.ttl(), e.ip.To16())
+		}
+		// the name exists, just not with an address of this family
+		return dnsErrorReply(query, end, 0)
+	case dnsTypePTR:
+		ip := reverseNameIP(name)
+		if ip == nil {
+			return dnsErrorReply(query, end, dnsRcodeNXDomain)
+		}
+		r.Lock()
+		onion, ok := r.cache["onion:"+ip.String()]
+		r.Unlock()
+		if ok && time.Now().Before(onion.expires) {
+			return dnsAnswerReply(query, end, qtype, onion.ttl(), dnsName(onion.name))
+		}
+		e := r.lookup("addr:"+ip.String(), func() (resolverEntry, error) {
+			return r.resolvePTR(ip)
+		})
+		if e.rcode != 0 {
+			return dnsErrorReply(query, end, e.rcode)
+		}
+		return dnsAnswerReply(query, end, qtype, e.ttl(), dnsName(e.name))
+	}
+	return dnsErrorReply(query, end, dnsRcodeNotImp)
+}
+
+// lookup returns the cached entry for the key, calling resolve if there
+// is none or it expired. Failing to reach tor is not cached.
+func (r *socksResolver) lookup(key string, resolve func() (resolverEntry, error)) resolverEntry {
+	r.Lock()
+	e, ok := r.cache[key]
+	r.Unlock()
+	if ok && time.Now().Before(e.expires) {
+		return e
+	}
+
+	e, err := resolve()
+	if err != nil {
+		logrus.Warnf("Resolving %s through tor failed: %v", strings.TrimPrefix(strings.TrimPrefix(key, "name:"), "addr:"), err)
+		return resolverEntry{rcode: dnsRcodeServFail}
+	}
+	e.expires = time.Now().Add(resolverTTL)
+
+	r.Lock()
+	defer r.Unlock()
+	r.store(key, e)
+	return e
+}
+
+// store caches the entry, making room for it first if the cache is full.
+// The caller holds the lock.
+func (r *socksResolver) store(key string, e resolverEntry) {
+	if _, ok := r.cache[key]; !ok && len(r.cache) >= resolverCacheSize {
+		r.expire()
+	}
+	r.cache[key] = e
+}
+
+// expire drops the expired entries of the cache, or an arbitrary one if
+// none did. The caller holds the lock.
+func (r *socksResolver) expire() {
+	now := time.Now()
+	for k, e := range r.cache {
+		if now.After(e.expires) {
+			delete(r.cache, k)
+		}
+	}
+	for k := range r.cache {
+		if len(r.cache) < resolverCacheSize {
+			break
+		}
+		delete(r.cache, k)
+	}
+}
+
+func (r *socksResolver) resolve(name string) (resolverEntry, error) {
+	user, password := r.credentials()
+	atyp, addr, err := socksCommand(r.upstream, user, password, socksCmdResolve, 3, append([]byte{byte(len(name))}, name...))
+	if err != nil {
+		return r.failed(err)
+	}
+	if atyp != 1 && atyp != 4 {
+		return resolverEntry{}, fmt.Errorf("resolving %s returned address type %d", name, atyp)
+	}
+
+	ip := net.IP(addr)
+	if isOnionName(name) && r.virtualNet != nil && r.virtualNet.Contains(ip) {
+		r.Lock()
+		r.store("onion:"+ip.String(), resolverEntry{name: name, expires: time.Now().Add(resolverTTL)})
+		r.Unlock()
+	}
+	return resolverEntry{ip: ip}, nil
+}
+
+func (r *socksResolver) resolvePTR(ip net.IP) (resolverEntry, error) {
+	atyp, addr := byte(1), []byte(ip.To4())
+	if addr == nil {
+		atyp, addr = 4, ip.To16()
+	}
+	user, password := r.credentials()
+	atyp, name, err := socksCommand(r.upstream, user, password, socksCmdResolvePTR, atyp, addr)
+	if err != nil {
+		return r.failed(err)
+	}
+	if atyp != 3 {
+		return resolverEntry{}, fmt.Errorf("resolving %s returned address type %d", ip, atyp)
+	}
+	return resolverEntry{name: string(name)}, nil
+}
+
+// failed turns tor failing to resolve into an NXDOMAIN entry, and hands
+// back any other error.
+func (r *socksResolver) failed(err error) (resolverEntry, error) {
+	if e, ok := err.(socksReplyError); ok && e == socksHostUnreachable {
+		return resolverEntry{rcode: dnsRcodeNXDomain}, nil
+	}
+	return resolverEntry{}, err
+}
+
+// credentials returns the SOCKS credentials of the lookups, which keep
+// them off the circuits of the connections of the containers.
+func (r *socksResolver) credentials() (string, string) {
+	if r.upstream.User != nil {
+		password, _ := r.upstream.User.Password()
+		return r.upstream.User.Username(), password
+	}
+	return "onion:" + r.networkID, "dns"
+}
+
+func (e resolverEntry) ttl() uint32 {
+	ttl := uint32(time.Until(e.expires) / time.Second)
+	if ttl < 1 {
+		ttl = 1
+	}
+	return ttl
+}
+
+// reverseNameIP returns the address of an in-addr.arpa or ip6.arpa name,
+// or nil if it is not one.
+func reverseNameIP(name string) net.IP {
+	switch {
+	case strings.HasSuffix(name, ".in-addr.arpa"):
+		labels := strings.Split(strings.TrimSuffix(name, ".in-addr.arpa"), ".")
+		if len(labels) != net.IPv4len {
+			return nil
+		}
+		for i, j := 0, len(labels)-1; i < j; i, j = i+1, j-1 {
+			labels[i], labels[j] = labels[j], labels[i]
+		}
+		return net.ParseIP(strings.Join(labels, ".")).To4()
+	case strings.HasSuffix(name, ".ip6.arpa"):
+		nibbles := strings.Split(strings.TrimSuffix(name, ".ip6.arpa"), ".")
+		if len(nibbles) != 2*net.IPv6len {
+			return nil
+		}
+		var s []string
+		for i := len(nibbles) - 1; i >= 0; i -= 4 {
+			if i < 3 {
+				return nil
+			}
+			s = append(s, nibbles[i]+nibbles[i-1]+nibbles[i-2]+nibbles[i-3])
+		}
+		return net.ParseIP(strings.Join(s, ":"))
+	}
+	return nil
+}
+
+// dnsName encodes the name as a sequence of labels.
+func dnsName(name string) []byte {
+	var b []byte
+	for _, l := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		if l == "" {
+			continue
+		}
+		b = append(append(b, byte(len(l))), l...)
+	}
+	return append(b, 0)
+}
+
+// dnsAnswerReply builds a reply to the query with a single answer for the
+// name in its question.
+func dnsAnswerReply(query []byte, end int, qtype uint16, ttl uint32, rdata []byte) []byte {
+	r := dnsErrorReply(query, end, 0)
+	binary.BigEndian.PutUint16(r[6:8], 1)
+
+	// the name points back at the question
+	r = append(r, 0xc0, dnsHeaderSize)
+	var rr [10]byte
+	binary.BigEndian.PutUint16(rr[0:2], qtype)
+	binary.BigEndian.PutUint16(rr[2:4], 1) // IN
+	binary.BigEndian.PutUint32(rr[4:8], ttl)
+	binary.BigEndian.PutUint16(rr[8:10], uint16(len(rdata)))
+	return append(append(r, rr[:]...), rdata...)
+}
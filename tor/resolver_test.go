@@ -0,0 +1,125 @@
+package tor
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+// dnsQueryType builds a query for the name of the type.
+func dnsQueryType(id uint16, name string, qtype uint16) []byte {
+	q := dnsQuery(id, name)
+	binary.BigEndian.PutUint16(q[len(q)-4:], qtype)
+	return q
+}
+
+func TestSOCKSResolver(t *testing.T) {
+	socks := newFakeSOCKS5(t)
+	defer socks.listener.Close()
+	socks.names = map[string]net.IP{
+		"example.com": net.IPv4(93, 184, 216, 34),
+		"duckduckgogg42xjoc72x3sjasowoarfbgcmvfimaftt6twagswzczad.onion": net.IPv4(10, 192, 0, 5),
+	}
+	socks.addrs = map[string]string{"93.184.216.34": "example.com"}
+
+	upstream, err := parseProxyUpstream("socks5://"+socks.listener.Addr().String(), "socks5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, virtualNet, _ := net.ParseCIDR("10.192.0.0/10")
+	s := &dnsServer{resolver: newSOCKSResolver(upstream, "0123456789abcdef", virtualNet)}
+	if err := s.listen("127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	addr := s.udp.LocalAddr().String()
+
+	answer := func(reply []byte) []byte {
+		if binary.BigEndian.Uint16(reply[6:8]) != 1 {
+			t.Fatalf("expected an answer, got rcode %d", reply[3]&0x0f)
+		}
+		_, _, end, err := dnsQuestion(reply)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return reply[end+12:]
+	}
+
+	for i := 0; i < 2; i++ {
+		reply := exchangeUDP(t, addr, dnsQueryType(1, "example.com", dnsTypeA))
+		if ip := net.IP(answer(reply)); !ip.Equal(net.IPv4(93, 184, 216, 34)) {
+			t.Fatalf("expected example.com to resolve to 93.184.216.34, got %s", ip)
+		}
+	}
+	socks.Lock()
+	if len(socks.resolves) != 1 {
+		t.Fatalf("expected the second query to be answered from the cache, got %v", socks.resolves)
+	}
+	if socks.users[0] != "onion:0123456789abcdef:dns" {
+		t.Fatalf("unexpected credentials %q", socks.users[0])
+	}
+	socks.Unlock()
+
+	reply := exchangeUDP(t, addr, dnsQueryType(2, "34.216.184.93.in-addr.arpa", dnsTypePTR))
+	if name := answer(reply); string(name) != string(dnsName("example.com")) {
+		t.Fatalf("expected the address to resolve back to example.com, got %q", name)
+	}
+
+	// the onion is remembered, the reverse lookup is not sent to tor
+	onion := "duckduckgogg42xjoc72x3sjasowoarfbgcmvfimaftt6twagswzczad.onion"
+	exchangeUDP(t, addr, dnsQueryType(3, onion, dnsTypeA))
+	reply = exchangeUDP(t, addr, dnsQueryType(4, "5.0.192.10.in-addr.arpa", dnsTypePTR))
+	if name := answer(reply); string(name) != string(dnsName(onion)) {
+		t.Fatalf("expected the virtual address to resolve back to the onion, got %q", name)
+	}
+
+	for _, c := range []struct {
+		name  string
+		qtype uint16
+		rcode byte
+	}{
+		{"example.com", 15, dnsRcodeNotImp}, // MX
+		{"example.com", 16, dnsRcodeNotImp}, // TXT
+		{"example.com", 33, dnsRcodeNotImp}, // SRV
+		{"example.com", dnsTypeAAAA, 0},     // no ipv6 address
+		{"nonexistent.example", dnsTypeA, dnsRcodeNXDomain},
+		{"not.a.reverse.name", dnsTypePTR, dnsRcodeNXDomain},
+	} {
+		reply := exchangeUDP(t, addr, dnsQueryType(5, c.name, c.qtype))
+		if rcode := reply[3] & 0x0f; rcode != c.rcode || binary.BigEndian.Uint16(reply[6:8]) != 0 {
+			t.Errorf("%s type %d: expected rcode %d and no answers, got rcode %d", c.name, c.qtype, c.rcode, rcode)
+		}
+	}
+}
+
+func TestSOCKSResolverBounded(t *testing.T) {
+	r := newSOCKSResolver(nil, "0123456789abcdef", nil)
+	r.Lock()
+	for i := 0; i < resolverCacheSize+10; i++ {
+		r.store(fmt.Sprintf("onion:10.192.%d.%d", i>>8, i&0xff), resolverEntry{name: "example.onion", expires: time.Now().Add(resolverTTL)})
+	}
+	size := len(r.cache)
+	r.Unlock()
+	if size != resolverCacheSize {
+		t.Fatalf("expected the onions to be bounded to %d entries, got %d", resolverCacheSize, size)
+	}
+}
+
+func TestReverseNameIP(t *testing.T) {
+	tests := map[string]string{
+		"4.3.2.1.in-addr.arpa": "1.2.3.4",
+		"b.a.9.8.7.6.5.0.4.0.0.0.3.0.0.0.2.0.0.0.1.0.0.0.0.0.0.0.1.2.3.4.ip6.arpa": "4321:0:1:2:3:4:567:89ab",
+	}
+	for name, expected := range tests {
+		if ip := reverseNameIP(name); !ip.Equal(net.ParseIP(expected)) {
+			t.Errorf("%s: expected %s, got %s", name, expected, ip)
+		}
+	}
+	for _, name := range []string{"3.2.1.in-addr.arpa", "example.com", "x.3.2.1.in-addr.arpa"} {
+		if ip := reverseNameIP(name); ip != nil {
+			t.Errorf("%s: expected no address, got %s", name, ip)
+		}
+	}
+}
@@ -0,0 +1,234 @@
+package tor
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	"github.com/vishvananda/netns"
+)
+
+// sandboxChainPrefix starts the name of the chain in the container's
+// network namespace that the outgoing traffic of an endpoint goes through.
+const sandboxChainPrefix = "ONION-OUT-"
+
+// sandboxRules is the chain of an endpoint inside the container. The
+// OUTPUT chain only jumps to it for the addresses of the endpoint, so the
+// other networks of the container are left alone and every tor network the
+// container is on gets its own chain. The name the interface of the
+// endpoint gets in the container is only picked once the driver joined it,
+// so the jump cannot match on that.
+type sandboxRules struct {
+	chain string
+	// src and src6 are the addresses of the endpoint, src6 is empty without
+	// an ipv6 one
+	src, src6 string
+	// script and script6 are the iptables-restore and ip6tables-restore
+	// input of the chain
+	script, script6 string
+}
+
+// sandboxChain is the name of the chain of the endpoint, iptables allows at
+// most 28 characters.
+func sandboxChain(endpointID string) string {
+	if len(endpointID) > 12 {
+		endpointID = endpointID[:12]
+	}
+	return sandboxChainPrefix + endpointID
+}
+
+// getSandboxFirewall parses the option to turn off the firewall inside the
+// containers' network namespaces, it is on by default.
+func getSandboxFirewall(opts map[string]interface{}) (bool, error) {
+	v, ok := getOption(opts, sandboxFirewallOption)
+	if !ok || v == "" {
+		return true, nil
+	}
+	enabled, err := strconv.ParseBool(v)
+	if err != nil {
+		return false, fmt.Errorf("Invalid %s %q: %v", sandboxFirewallOption, v, err)
+	}
+	return enabled, nil
+}
+
+// sandboxFirewallScript renders the iptables-restore input for the chain of
+// the endpoint inside the container. The destination of tcp connections has to stay as
+// it is for the redirect on the host to recover it, so they cannot be
+// pinned to the gateway. What can be done is letting only new tcp
+// connections and dns out, which is all the host redirects into tor, and
+// dropping everything else.
+func (n *NetworkState) sandboxFirewallScript(chain string) string {
+	var rules [][]string
+	rules = append(rules,
+		[]string{"-o", "lo", "-j", "RETURN"},
+		[]string{"-m", "conntrack", "--ctstate", "RELATED,ESTABLISHED", "-j", "RETURN"},
+	)
+	for _, b := range n.bypass {
+		r := []string{"-d", b.dest.String()}
+		if b.proto != "" {
+			r = append(r, "-p", b.proto)
+		}
+		if b.port != "" {
+			r = append(r, "--dport", b.port)
+		}
+		rules = append(rules, append(r, "-j", "RETURN"))
+	}
+	rules = append(rules,
+		[]string{"-p", "udp", "--dport", "53", "-j", "RETURN"},
+		[]string{"-p", "tcp", "--dport", "53", "-j", "RETURN"},
+	)
+	rules = append(rules, n.sandboxICCRules()...)
+	for _, p := range n.hostAllow {
+		rules = append(rules, []string{"-d", n.Gateway, "-p", p.proto, "--dport", p.port, "-j", "RETURN"})
+	}
+	tcp := []string{"-p", "tcp", "--syn", "-j", "RETURN"}
+	if n.onionOnly {
+		tcp = append([]string{"-d", n.virtualNet.String()}, tcp...)
+	}
+	if n.i2p == i2pOnly {
+		tcp = append([]string{"-d", n.i2pNet.String()}, tcp...)
+	}
+	rules = append(rules, tcp, []string{"-j", "DROP"})
+
+	return sandboxScript(chain, rules)
+}
+
+// sandboxFirewallScript6 renders the ip6tables-restore input for the chain
+// of the endpoint inside the container, nothing goes through tor over ipv6.
+func sandboxFirewallScript6(chain string) string {
+	return sandboxScript(chain, [][]string{{"-j", "DROP"}})
+}
+
+func sandboxScript(chain string, rules [][]string) string {
+	var b bytes.Buffer
+	b.WriteString("*filter\n")
+	fmt.Fprintf(&b, ":%s - [0:0]\n", chain)
+	for _, r := range rules {
+		fmt.Fprintf(&b, "-A %s %s\n", chain, strings.Join(r, " "))
+	}
+	b.WriteString("COMMIT\n")
+	return b.String()
+}
+
+// sandboxRules returns the chain of the endpoint inside the container.
+func (n *NetworkState) sandboxRules(ep *torEndpoint) sandboxRules {
+	chain := sandboxChain(ep.id)
+	fw := sandboxRules{
+		chain:  chain,
+		src:    ep.addr.IP.String(),
+		script: n.sandboxFirewallScript(chain),
+	}
+	if ep.addrv6 != nil {
+		fw.src6 = ep.addrv6.IP.String()
+		fw.script6 = sandboxFirewallScript6(chain)
+	}
+	return fw
+}
+
+// setupSandboxFirewall installs a firewall for the endpoint inside the
+// network namespace of the container, on top of the rules on the host, so
+// both have to fail for anything to leak.
+func (n *NetworkState) setupSandboxFirewall(ep *torEndpoint, sandboxKey string) error {
+	if !n.sandboxFirewall || sandboxKey == "" {
+		return nil
+	}
+	if ep.addr == nil {
+		logrus.Warnf("Endpoint %s has no address, not setting up the firewall in sandbox %s", ep.id, sandboxKey)
+		return nil
+	}
+
+	if err := n.host.setupSandboxFirewall(sandboxKey, n.sandboxRules(ep)); err != nil {
+		return err
+	}
+	n.Lock()
+	ep.sandboxKey = sandboxKey
+	n.Unlock()
+	return nil
+}
+
+// removeSandboxFirewall removes the firewall of the endpoint from the
+// network namespace of the container it left.
+func (n *NetworkState) removeSandboxFirewall(ep *torEndpoint) error {
+	n.Lock()
+	sandboxKey := ep.sandboxKey
+	ep.sandboxKey = ""
+	n.Unlock()
+	if sandboxKey == "" {
+		return nil
+	}
+
+	return n.host.removeSandboxFirewall(sandboxKey, n.sandboxRules(ep))
+}
+
+// sandboxRestore replaces the chain in the current network namespace and
+// makes sure the OUTPUT chain jumps to it for the source address.
+func sandboxRestore(cmd, chain, src, script string) error {
+	restore := exec.Command(cmd+"-restore", "--noflush")
+	restore.Stdin = strings.NewReader(script)
+	if output, err := restore.CombinedOutput(); err != nil {
+		return fmt.Errorf("%s-restore failed: %v: %s", cmd, err, strings.TrimSpace(string(output)))
+	}
+
+	jump := []string{"OUTPUT", "-s", src, "-j", chain}
+	if exec.Command(cmd, append([]string{"-C"}, jump...)...).Run() == nil {
+		return nil
+	}
+	if output, err := exec.Command(cmd, append([]string{"-I"}, jump...)...).CombinedOutput(); err != nil {
+		return fmt.Errorf("%s -I OUTPUT failed: %v: %s", cmd, err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// sandboxRemove deletes the jump to the chain and the chain from the
+// current network namespace.
+func sandboxRemove(cmd, chain, src string) error {
+	jump := []string{"OUTPUT", "-s", src, "-j", chain}
+	for exec.Command(cmd, append([]string{"-C"}, jump...)...).Run() == nil {
+		if output, err := exec.Command(cmd, append([]string{"-D"}, jump...)...).CombinedOutput(); err != nil {
+			return fmt.Errorf("%s -D OUTPUT failed: %v: %s", cmd, err, strings.TrimSpace(string(output)))
+		}
+	}
+	for _, args := range [][]string{{"-F", chain}, {"-X", chain}} {
+		if exec.Command(cmd, "-n", "-L", chain).Run() != nil {
+			return nil
+		}
+		if output, err := exec.Command(cmd, args...).CombinedOutput(); err != nil {
+			return fmt.Errorf("%s %s failed: %v: %s", cmd, strings.Join(args, " "), err, strings.TrimSpace(string(output)))
+		}
+	}
+	return nil
+}
+
+// inSandbox runs fn in the network namespace at sandboxKey. Commands started
+// by fn run in that namespace as well.
+func inSandbox(sandboxKey string, fn func() error) error {
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	origin, err := netns.Get()
+	if err != nil {
+		return fmt.Errorf("getting the current network namespace failed: %v", err)
+	}
+	defer origin.Close()
+
+	sandbox, err := netns.GetFromPath(sandboxKey)
+	if err != nil {
+		return fmt.Errorf("getting the network namespace %s failed: %v", sandboxKey, err)
+	}
+	defer sandbox.Close()
+
+	if err := netns.Set(sandbox); err != nil {
+		return fmt.Errorf("entering the network namespace %s failed: %v", sandboxKey, err)
+	}
+	defer func() {
+		if err := netns.Set(origin); err != nil {
+			logrus.Errorf("Returning to the original network namespace failed: %v", err)
+		}
+	}()
+
+	return fn()
+}
@@ -0,0 +1,56 @@
+package tor
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestSandboxFirewallScript(t *testing.T) {
+	_, virtualNet, _ := net.ParseCIDR(defaultVirtualAddrNetwork)
+	n := &NetworkState{
+		Gateway:    "172.18.0.1",
+		hostAllow:  []portSpec{{port: "5000", proto: "tcp"}},
+		onionOnly:  true,
+		virtualNet: virtualNet,
+	}
+
+	script := n.sandboxFirewallScript("ONION-OUT-fedcba987654")
+	for _, rule := range []string{
+		"-A ONION-OUT-fedcba987654 -o lo -j RETURN",
+		"-A ONION-OUT-fedcba987654 -p udp --dport 53 -j RETURN",
+		"-A ONION-OUT-fedcba987654 -d 172.18.0.1 -p tcp --dport 5000 -j RETURN",
+		"-A ONION-OUT-fedcba987654 -d 10.192.0.0/10 -p tcp --syn -j RETURN",
+	} {
+		if !strings.Contains(script, rule+"\n") {
+			t.Errorf("expected rule %q in script:\n%s", rule, script)
+		}
+	}
+	if !strings.HasSuffix(script, "-A ONION-OUT-fedcba987654 -j DROP\nCOMMIT\n") {
+		t.Errorf("expected the script to end with a drop:\n%s", script)
+	}
+}
+
+func TestSandboxRules(t *testing.T) {
+	n := &NetworkState{Gateway: "172.18.0.1"}
+	ep := &torEndpoint{id: "fedcba9876543210abcdef", addr: &net.IPNet{IP: net.IPv4(172, 18, 0, 2)}}
+
+	rules := n.sandboxRules(ep)
+	if rules.chain != "ONION-OUT-fedcba987654" || len(rules.chain) > 28 {
+		t.Fatalf("unexpected chain %q", rules.chain)
+	}
+	// only the traffic of the endpoint goes through the chain
+	if rules.src != "172.18.0.2" {
+		t.Fatalf("expected the jump to match 172.18.0.2, got %q", rules.src)
+	}
+	// without an ipv6 address the ipv6 traffic of the container is left
+	// alone
+	if rules.src6 != "" || rules.script6 != "" {
+		t.Fatalf("expected no ipv6 rules, got %+v", rules)
+	}
+
+	ep.addrv6 = &net.IPNet{IP: net.ParseIP("fd00::2")}
+	if rules := n.sandboxRules(ep); rules.src6 != "fd00::2" || !strings.Contains(rules.script6, "-A ONION-OUT-fedcba987654 -j DROP\n") {
+		t.Fatalf("expected the ipv6 address of the endpoint to be dropped, got %+v", rules)
+	}
+}
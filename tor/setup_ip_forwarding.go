@@ -3,11 +3,13 @@ package tor
 import (
 	"fmt"
 	"io/ioutil"
+	"os"
 )
 
 const (
 	ipv4ForwardConf     = "/proc/sys/net/ipv4/ip_forward"
 	ipv4ForwardConfPerm = 0644
+	ipv6DisableConf     = "/proc/sys/net/ipv6/conf/%s/disable_ipv6"
 )
 
 func setupIPForwarding() error {
@@ -27,3 +29,31 @@ func setupIPForwarding() error {
 
 	return nil
 }
+
+// disableIPv6 turns ipv6 off on the interface, tor does not route it so
+// anything sent over it would bypass tor.
+func disableIPv6(iface string) error {
+	conf := fmt.Sprintf(ipv6DisableConf, iface)
+	if _, err := os.Stat(conf); os.IsNotExist(err) {
+		// ipv6 is disabled in the kernel
+		return nil
+	}
+
+	if err := ioutil.WriteFile(conf, []byte{'1', '\n'}, ipv4ForwardConfPerm); err != nil {
+		return fmt.Errorf("Disabling ipv6 on %s failed: %v", iface, err)
+	}
+
+	return nil
+}
+
+// ipv6Disabled reports whether ipv6 is off on the interface.
+func ipv6Disabled(iface string) (bool, error) {
+	data, err := ioutil.ReadFile(fmt.Sprintf(ipv6DisableConf, iface))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return true, nil
+		}
+		return false, err
+	}
+	return len(data) > 0 && data[0] == '1', nil
+}
@@ -1,11 +1,14 @@
 package tor
 
 import (
+	"bytes"
 	"fmt"
-	"net"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
 
 	"github.com/docker/libnetwork/iptables"
-	"github.com/docker/libnetwork/netutils"
 	"github.com/sirupsen/logrus"
 )
 
@@ -15,6 +18,10 @@ const (
 	hairpinMode             = false
 	torTransparentProxyPort = "22340"
 	torDNSPort              = "22353"
+	torDNSUpstream          = "127.0.0.1:" + torDNSPort
+	// dnsProxyPort is the port the plugin answers dns queries on, over
+	// tcp for every network and over udp for onion-only networks.
+	dnsProxyPort = "22354"
 )
 
 func setupIPChains() (*iptables.ChainInfo, *iptables.ChainInfo, error) {
@@ -38,258 +45,509 @@ func setupIPChains() (*iptables.ChainInfo, *iptables.ChainInfo, error) {
 	return natChain, filterChain, nil
 }
 
-type iptablesConfig struct {
-	bridgeName  string
-	torIP       string
-	addr        *net.IPNet
-	hairpinMode bool
-	iccMode     bool
-	ipMasqMode  bool
-	blockUDP    bool
+// iptablesFirewall programs the policy with iptables. Each network gets its
+// own chains which the builtin chains jump to, all of them are programmed
+// in a single iptables-restore transaction.
+type iptablesFirewall struct{}
+
+// iptablesTables are the tables of the policy, in the order they are
+// committed in.
+var iptablesTables = []string{"filter", "nat"}
+
+// iptablesChainPrefixes maps the builtin chains to the prefix of the
+// network's own chain.
+var iptablesChainPrefixes = map[string]string{
+	"PREROUTING":  "TOR-PRE-",
+	"POSTROUTING": "TOR-POST-",
+	"FORWARD":     "TOR-FWD-",
+	"INPUT":       "TOR-IN-",
 }
 
-func (n *NetworkState) setupIPTables(torIP string) error {
-	addrv4, _, err := netutils.GetIfaceAddr(n.BridgeName)
-	if err != nil {
-		return fmt.Errorf("Failed to setup IP tables, cannot acquire interface address for bridge %s: %v", n.BridgeName, err)
+// iptablesChain returns the name of the network's chain that the rules of
+// the builtin chain are programmed in.
+func iptablesChain(bridgeName, chain string) string {
+	return iptablesChainPrefixes[chain] + bridgeName
+}
+
+// iptablesJumps returns the rules jumping from the builtin chains to the
+// network's chains.
+func iptablesJumps(bridgeName string) []firewallRule {
+	return []firewallRule{
+		{table: "filter", chain: "FORWARD", in: bridgeName, target: iptablesChain(bridgeName, "FORWARD")},
+		{table: "filter", chain: "FORWARD", out: bridgeName, target: iptablesChain(bridgeName, "FORWARD")},
+		{table: "filter", chain: "INPUT", in: bridgeName, target: iptablesChain(bridgeName, "INPUT")},
+		{table: "nat", chain: "PREROUTING", in: bridgeName, target: iptablesChain(bridgeName, "PREROUTING")},
+		{table: "nat", chain: "POSTROUTING", target: iptablesChain(bridgeName, "POSTROUTING")},
 	}
+}
+
+func (f *iptablesFirewall) program(n *NetworkState, rules []firewallRule) error {
+	var err error
 
-	ic := &iptablesConfig{
-		bridgeName:  n.BridgeName,
-		torIP:       torIP,
-		hairpinMode: hairpinMode,
-		iccMode:     true,
-		ipMasqMode:  true,
-		blockUDP:    n.blockUDP,
+	// setup the shared chain the port mappings go in
+	if n.natChain == nil {
+		if err := f.setupPortMappingChains(n); err != nil {
+			return err
+		}
 	}
 
-	ipnet := addrv4.(*net.IPNet)
-	ic.addr = &net.IPNet{
-		IP:   ipnet.IP.Mask(ipnet.Mask),
-		Mask: ipnet.Mask,
+	script := iptablesProgramScript(n.BridgeName, rules, missingRules(iptablesJumps(n.BridgeName)))
+	logrus.Debugf("Programming iptables for bridge %s:\n%s", n.BridgeName, script)
+	if err = iptablesRestore(script); err != nil {
+		// The tables are committed one at a time, so put back what was
+		// there before rather than leaving the bridge half protected.
+		if rerr := f.rollback(n); rerr != nil {
+			logrus.Warnf("Failed to roll back iptables rules for bridge %s: %v", n.BridgeName, rerr)
+		}
+		return err
 	}
 
-	if err = ic.setupIPTablesInternal(true); err != nil {
-		return fmt.Errorf("setup iptables failed for bridge %s: %v", n.BridgeName, err)
+	return nil
+}
+
+// rollback restores the rules last programmed for the network, or removes
+// them altogether if there were none.
+func (f *iptablesFirewall) rollback(n *NetworkState) error {
+	if n.rules == nil {
+		return iptablesRestore(iptablesRemoveScript(n.BridgeName, existingRules(iptablesJumps(n.BridgeName))))
+	}
+	return iptablesRestore(iptablesProgramScript(n.BridgeName, n.rules, missingRules(iptablesJumps(n.BridgeName))))
+}
+
+func (f *iptablesFirewall) setupPortMappingChains(n *NetworkState) error {
+	var err error
+
+	// setup iptables chains
+	n.natChain, n.filterChain, err = setupIPChains()
+	if err != nil {
+		return fmt.Errorf("Setup iptables chains failed: %v", err)
 	}
-	n.registerIptCleanFunc(func() error {
-		return ic.setupIPTablesInternal(false)
-	})
 
-	err = iptables.ProgramChain(n.natChain, n.BridgeName, ic.hairpinMode, true)
+	err = iptables.ProgramChain(n.natChain, n.BridgeName, hairpinMode, true)
 	if err != nil {
 		return fmt.Errorf("Failed to program NAT chain: %s", err.Error())
 	}
 	n.registerIptCleanFunc(func() error {
-		return iptables.ProgramChain(n.natChain, n.BridgeName, ic.hairpinMode, false)
+		return iptables.ProgramChain(n.natChain, n.BridgeName, hairpinMode, false)
 	})
 
-	err = iptables.ProgramChain(n.filterChain, n.BridgeName, ic.hairpinMode, true)
+	err = iptables.ProgramChain(n.filterChain, n.BridgeName, hairpinMode, true)
 	if err != nil {
 		return fmt.Errorf("Failed to program FILTER chain: %s", err.Error())
 	}
 	n.registerIptCleanFunc(func() error {
-		return iptables.ProgramChain(n.filterChain, n.BridgeName, ic.hairpinMode, false)
+		return iptables.ProgramChain(n.filterChain, n.BridgeName, hairpinMode, false)
 	})
 
 	n.portMapper.SetIptablesChain(n.filterChain, n.BridgeName)
 
-	// forward to tor
-	if err := ic.forwardToTor(iptables.Insert); err != nil {
-		return fmt.Errorf("Redirecting traffic from bridge (%s) to torIP (%s) via iptables failed: %v", n.BridgeName, torIP, err)
-	}
-	n.registerIptCleanFunc(func() error {
-		return ic.forwardToTor(iptables.Delete)
-	})
-
 	return nil
 }
 
-type iptableCleanFunc func() error
-type iptablesCleanFuncs []iptableCleanFunc
+func (f *iptablesFirewall) cleanup(n *NetworkState) error {
+	// delete the network's chains and the jumps to them
+	if err := iptablesRestore(iptablesRemoveScript(n.BridgeName, existingRules(iptablesJumps(n.BridgeName)))); err != nil {
+		logrus.Warnf("Failed to remove iptables chains for bridge %s: %v", n.BridgeName, err)
+	}
 
-func (n *NetworkState) registerIptCleanFunc(clean iptableCleanFunc) {
-	n.iptCleanFuncs = append(n.iptCleanFuncs, clean)
-}
+	// delete all relevant iptables rules
+	for _, cleanFunc := range n.iptCleanFuncs {
+		if err := cleanFunc(); err != nil {
+			logrus.Warnf("Failed to clean iptables rules for bridge %s: %v", n.BridgeName, err)
+		}
+	}
+	n.iptCleanFuncs = nil
 
-type iptRule struct {
-	table   iptables.Table
-	chain   string
-	preArgs []string
-	args    []string
-}
+	// delete all the iptables chains
+	if err := iptables.RemoveExistingChain(TorChain, iptables.Nat); err != nil {
+		logrus.Warnf("Failed on removing iptables NAT chain on cleanup: %v", err)
+	}
+	if err := iptables.RemoveExistingChain(TorChain, iptables.Filter); err != nil {
+		logrus.Warnf("Failed on removing iptables FILTER chain on cleanup: %v", err)
+	}
 
-func (ic *iptablesConfig) setupIPTablesInternal(enable bool) error {
+	return nil
+}
 
-	var (
-		address   = ic.addr.String()
-		natRule   = iptRule{table: iptables.Nat, chain: "POSTROUTING", preArgs: []string{"-t", "nat"}, args: []string{"-s", address, "!", "-o", ic.bridgeName, "-j", "MASQUERADE"}}
-		hpNatRule = iptRule{table: iptables.Nat, chain: "POSTROUTING", preArgs: []string{"-t", "nat"}, args: []string{"-m", "addrtype", "--src-type", "LOCAL", "-o", ic.bridgeName, "-j", "MASQUERADE"}}
-		outRule   = iptRule{table: iptables.Filter, chain: "FORWARD", args: []string{"-i", ic.bridgeName, "!", "-o", ic.bridgeName, "-j", "ACCEPT"}}
-		inRule    = iptRule{table: iptables.Filter, chain: "FORWARD", args: []string{"-o", ic.bridgeName, "-m", "conntrack", "--ctstate", "RELATED,ESTABLISHED", "-j", "ACCEPT"}}
-	)
+// check looks for the jumps anywhere in the builtin chains, and compares the
+// network's own chains rule by rule, in order, by the tags in the comments
+// of the rules.
+func (f *iptablesFirewall) check(n *NetworkState, rules []firewallRule) ([]firewallRule, error) {
+	missing := missingRules(iptablesJumps(n.BridgeName))
+	for _, table := range iptablesTables {
+		for _, chain := range policyChains(table) {
+			var expected []firewallRule
+			for _, r := range rules {
+				if r.table == table && r.chain == chain {
+					expected = append(expected, r)
+				}
+			}
 
-	// Set NAT.
-	if ic.ipMasqMode {
-		if err := programChainRule(natRule, "NAT", enable); err != nil {
-			return err
+			out, err := iptables.Raw("-t", table, "-S", iptablesChain(n.BridgeName, chain))
+			if err != nil {
+				if strings.Contains(err.Error(), "No chain") {
+					// the whole chain is gone
+					missing = append(missing, expected...)
+					continue
+				}
+				return nil, err
+			}
+			drifted, err := n.driftedRules(expected, iptablesRuleComments(string(out)), func(r firewallRule) (string, error) {
+				return ruleTag(strings.Join(r.iptablesArgs(), " ")), nil
+			})
+			if err != nil {
+				return nil, err
+			}
+			missing = append(missing, drifted...)
 		}
 	}
+	return missing, nil
+}
 
-	// In hairpin mode, masquerade traffic from localhost
-	if ic.hairpinMode {
-		if err := programChainRule(hpNatRule, "MASQ LOCAL HOST", enable); err != nil {
-			return err
+// shadowed returns the rules that come before the jumps to the network's
+// chains and accept or redirect traffic the jumps would have seen.
+func (f *iptablesFirewall) shadowed(n *NetworkState) ([]string, error) {
+	var shadowed []string
+	seen := map[string]bool{}
+	for _, j := range iptablesJumps(n.BridgeName) {
+		// skipping the masquerade rules does not leak anything
+		if j.chain == "POSTROUTING" {
+			continue
+		}
+		out, err := iptables.Raw("-t", j.table, "-S", j.chain)
+		if err != nil {
+			return nil, err
+		}
+		for _, r := range shadowingRules(string(out), j) {
+			r = "-t " + j.table + " " + r
+			if !seen[r] {
+				seen[r] = true
+				shadowed = append(shadowed, r)
+			}
 		}
 	}
+	return shadowed, nil
+}
 
-	// Set Inter Container Communication.
-	if err := setIcc(ic.bridgeName, ic.iccMode, enable); err != nil {
-		return err
+// counters reads the counters of the rules in the network's chains.
+func (f *iptablesFirewall) counters(n *NetworkState) (map[string]uint64, error) {
+	counters := map[string]uint64{}
+	for _, table := range iptablesTables {
+		for _, chain := range policyChains(table) {
+			out, err := iptables.Raw("-t", table, "-v", "-S", iptablesChain(n.BridgeName, chain))
+			if err != nil {
+				return nil, err
+			}
+			for comment, packets := range iptablesCounters(string(out)) {
+				counters[comment] += packets
+			}
+		}
 	}
+	return counters, nil
+}
 
-	// Set Accept on all non-intercontainer outgoing packets.
-	if err := programChainRule(outRule, "ACCEPT NON_ICC OUTGOING", enable); err != nil {
-		return err
+// iptablesCounters parses the packet counters of the rules with a comment
+// from the output of `iptables -v -S`.
+func iptablesCounters(output string) map[string]uint64 {
+	counters := map[string]uint64{}
+	for _, line := range strings.Split(output, "\n") {
+		if !strings.HasPrefix(line, "-A ") {
+			continue
+		}
+		var packets uint64
+		fields := strings.Fields(line)
+		for i := 0; i+1 < len(fields); i++ {
+			if fields[i] == "-c" {
+				packets, _ = strconv.ParseUint(fields[i+1], 10, 64)
+			}
+		}
+		if comment, _ := splitRuleComment(iptablesComment(line)); comment != "" {
+			counters[comment] += packets
+		}
 	}
-
-	// Set Accept on incoming packets for existing connections.
-	return programChainRule(inRule, "ACCEPT INCOMING", enable)
+	return counters
 }
 
-func programChainRule(rule iptRule, ruleDescr string, enable bool) error {
-	var (
-		prefix    []string
-		condition bool
-		doesExist = iptables.Exists(rule.table, rule.chain, rule.args...)
-	)
+var iptablesCommentRegexp = regexp.MustCompile(`--comment (?:"([^"]*)"|(\S+))`)
 
-	action := iptables.Insert
-	condition = !doesExist
-	if !enable {
-		action = iptables.Delete
-		condition = doesExist
+// iptablesComment returns the comment of a rule printed by `iptables -S`.
+func iptablesComment(line string) string {
+	m := iptablesCommentRegexp.FindStringSubmatch(line)
+	if m == nil {
+		return ""
 	}
-	prefix = []string{string(action), rule.chain}
+	return m[1] + m[2]
+}
 
-	if rule.preArgs != nil {
-		prefix = append(rule.preArgs, prefix...)
+// iptablesRuleComments returns the comments of the rules in the output of
+// `iptables -S` for a chain, in order, empty for rules without one.
+func iptablesRuleComments(output string) []string {
+	var comments []string
+	for _, line := range strings.Split(output, "\n") {
+		if strings.HasPrefix(line, "-A ") {
+			comments = append(comments, iptablesComment(line))
+		}
 	}
+	return comments
+}
 
-	if condition {
-		if output, err := iptables.Raw(append(prefix, rule.args...)...); err != nil {
-			return fmt.Errorf("Unable to %s %s rule: %v", action, ruleDescr, err)
-		} else if len(output) != 0 {
-			return &iptables.ChainError{Chain: rule.chain, Output: output}
+// shadowingRules returns the rules of the output of `iptables -S` that come
+// before the jump and let through traffic the jump would have matched.
+func shadowingRules(output string, jump firewallRule) []string {
+	var rules []string
+	for _, line := range strings.Split(output, "\n") {
+		if !strings.HasPrefix(line, "-A ") {
+			continue
+		}
+		r := parseIptablesRule(line)
+		if r.target == jump.target && r.in == jump.in && r.out == jump.out {
+			break
 		}
+		switch r.target {
+		case "ACCEPT", "RETURN", "DNAT", "REDIRECT":
+		default:
+			continue
+		}
+		if jump.in != "" && !ifaceMatches(r.in, jump.in) {
+			continue
+		}
+		if jump.out != "" && !ifaceMatches(r.out, jump.out) {
+			continue
+		}
+		rules = append(rules, line)
 	}
+	return rules
+}
 
-	return nil
+// parseIptablesRule parses the interfaces and target of a rule printed by
+// `iptables -S`.
+func parseIptablesRule(line string) firewallRule {
+	var r firewallRule
+	fields := strings.Fields(line)
+	for i := 0; i+1 < len(fields); i++ {
+		negate := ""
+		if i > 0 && fields[i-1] == "!" {
+			negate = "!"
+		}
+		switch fields[i] {
+		case "-i":
+			r.in = negate + fields[i+1]
+		case "-o":
+			r.out = negate + fields[i+1]
+		case "-j":
+			r.target = fields[i+1]
+		}
+	}
+	return r
 }
 
-func setIcc(bridgeIface string, iccEnable, insert bool) error {
-	var (
-		table      = iptables.Filter
-		chain      = "FORWARD"
-		args       = []string{"-i", bridgeIface, "-o", bridgeIface, "-p", "tcp", "-j"}
-		acceptArgs = append(args, "ACCEPT")
-		dropArgs   = append(args, "DROP")
-	)
-
-	if insert {
-		if !iccEnable {
-			iptables.Raw(append([]string{"-D", chain}, acceptArgs...)...)
-
-			if !iptables.Exists(table, chain, dropArgs...) {
-				if output, err := iptables.Raw(append([]string{"-A", chain}, dropArgs...)...); err != nil {
-					return fmt.Errorf("Unable to prevent intercontainer communication: %v", err)
-				} else if len(output) != 0 {
-					return fmt.Errorf("Error disabling intercontainer communication: %s", output)
-				}
-			}
-		} else {
-			iptables.Raw(append([]string{"-D", chain}, dropArgs...)...)
-
-			if !iptables.Exists(table, chain, acceptArgs...) {
-				if output, err := iptables.Raw(append([]string{"-I", chain}, acceptArgs...)...); err != nil {
-					return fmt.Errorf("Unable to allow intercontainer communication: %v", err)
-				} else if len(output) != 0 {
-					return fmt.Errorf("Error enabling intercontainer communication: %s", output)
-				}
+// ifaceMatches reports whether the interface match of a rule, possibly
+// negated or ending in the "+" wildcard, matches the interface.
+func ifaceMatches(match, iface string) bool {
+	if match == "" {
+		return true
+	}
+	negate := strings.HasPrefix(match, "!")
+	match = strings.TrimPrefix(match, "!")
+	matches := match == iface
+	if strings.HasSuffix(match, "+") {
+		matches = strings.HasPrefix(iface, strings.TrimSuffix(match, "+"))
+	}
+	return matches != negate
+}
+
+// iptablesProgramScript renders the input for iptables-restore that
+// replaces the contents of the network's chains with the rules and inserts
+// the given jumps to them.
+func iptablesProgramScript(bridgeName string, rules, jumps []firewallRule) string {
+	var b bytes.Buffer
+	for _, table := range iptablesTables {
+		fmt.Fprintf(&b, "*%s\n", table)
+		// declaring the chains creates them, or flushes them if they exist
+		for _, chain := range policyChains(table) {
+			fmt.Fprintf(&b, ":%s - [0:0]\n", iptablesChain(bridgeName, chain))
+		}
+		for _, r := range rules {
+			if r.table == table {
+				fmt.Fprintf(&b, "-A %s %s\n", iptablesChain(bridgeName, r.chain), iptablesScriptArgs(r.iptablesTagged()))
 			}
 		}
-	} else {
-		// Remove any ICC rule.
-		if !iccEnable {
-			if iptables.Exists(table, chain, dropArgs...) {
-				iptables.Raw(append([]string{"-D", chain}, dropArgs...)...)
+		for _, j := range jumps {
+			if j.table == table {
+				fmt.Fprintf(&b, "-I %s %s\n", j.chain, strings.Join(j.iptablesArgs(), " "))
 			}
-		} else {
-			if iptables.Exists(table, chain, acceptArgs...) {
-				iptables.Raw(append([]string{"-D", chain}, acceptArgs...)...)
+		}
+		b.WriteString("COMMIT\n")
+	}
+	return b.String()
+}
+
+// iptablesRemoveScript renders the input for iptables-restore that deletes
+// the given jumps and the network's chains.
+func iptablesRemoveScript(bridgeName string, jumps []firewallRule) string {
+	var b bytes.Buffer
+	for _, table := range iptablesTables {
+		fmt.Fprintf(&b, "*%s\n", table)
+		for _, j := range jumps {
+			if j.table == table {
+				fmt.Fprintf(&b, "-D %s %s\n", j.chain, strings.Join(j.iptablesArgs(), " "))
 			}
 		}
+		for _, chain := range policyChains(table) {
+			fmt.Fprintf(&b, ":%s - [0:0]\n", iptablesChain(bridgeName, chain))
+			fmt.Fprintf(&b, "-X %s\n", iptablesChain(bridgeName, chain))
+		}
+		b.WriteString("COMMIT\n")
 	}
+	return b.String()
+}
 
-	return nil
+// policyChains returns the builtin chains of the table the policy has
+// rules in.
+func policyChains(table string) []string {
+	if table == "nat" {
+		return []string{"PREROUTING", "POSTROUTING"}
+	}
+	return []string{"FORWARD", "INPUT"}
 }
 
-func (ic *iptablesConfig) forwardToTor(action iptables.Action) error {
-	// route dns requests
-	args := []string{"-t", string(iptables.Nat), string(action), "PREROUTING",
-		"-i", ic.bridgeName,
-		"-p", "udp",
-		"--dport", "53",
-		"-j", "REDIRECT",
-		"--to-ports", torDNSPort}
-	if output, err := iptables.Raw(args...); err != nil {
-		return err
-	} else if len(output) != 0 {
-		return iptables.ChainError{Chain: "PREROUTING", Output: output}
-	}
-
-	// route tcp requests
-	args = []string{"-t", string(iptables.Nat), string(action), "PREROUTING",
-		"-i", ic.bridgeName,
-		"-p", "tcp",
-		"--syn",
-		"-j", "REDIRECT",
-		"--to-ports", torTransparentProxyPort}
-	if output, err := iptables.Raw(args...); err != nil {
-		return err
-	} else if len(output) != 0 {
-		return iptables.ChainError{Chain: "PREROUTING", Output: output}
+// missingRules returns the rules that are not programmed.
+func missingRules(rules []firewallRule) []firewallRule {
+	var missing []firewallRule
+	for _, r := range rules {
+		rule := r.iptRule()
+		if !iptables.Exists(rule.table, rule.chain, rule.args...) {
+			missing = append(missing, r)
+		}
 	}
+	return missing
+}
 
-	// block udp traffic
-	if ic.blockUDP {
-		args := []string{"-t", string(iptables.Filter), string(action), "FORWARD",
-			"-i", ic.bridgeName,
-			"-p", "udp",
-			"-j", "DROP"}
-		if output, err := iptables.Raw(args...); err != nil {
-			return err
-		} else if len(output) != 0 {
-			return iptables.ChainError{Chain: "FORWARD", Output: output}
+// existingRules returns the rules that are programmed.
+func existingRules(rules []firewallRule) []firewallRule {
+	var existing []firewallRule
+	for _, r := range rules {
+		rule := r.iptRule()
+		if iptables.Exists(rule.table, rule.chain, rule.args...) {
+			existing = append(existing, r)
 		}
-		args = []string{"-t", string(iptables.Filter), string(action), "FORWARD",
-			"-o", ic.bridgeName,
-			"-p", "udp",
-			"-j", "DROP"}
-		if output, err := iptables.Raw(args...); err != nil {
-			return err
-		} else if len(output) != 0 {
-			return iptables.ChainError{Chain: "FORWARD", Output: output}
+	}
+	return existing
+}
+
+// iptablesRestore applies the script in one iptables-restore run, leaving
+// the rules and chains that are not in it alone.
+func iptablesRestore(script string) error {
+	cmd := exec.Command("iptables-restore", "--noflush")
+	cmd.Stdin = strings.NewReader(script)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("iptables-restore failed: %v: %s", err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+type iptableCleanFunc func() error
+type iptablesCleanFuncs []iptableCleanFunc
+
+func (n *NetworkState) registerIptCleanFunc(clean iptableCleanFunc) {
+	n.iptCleanFuncs = append(n.iptCleanFuncs, clean)
+}
+
+type iptRule struct {
+	table   iptables.Table
+	chain   string
+	preArgs []string
+	args    []string
+}
+
+// iptRule converts the rule into the form used to program it.
+func (r firewallRule) iptRule() iptRule {
+	rule := iptRule{table: iptables.Table(r.table), chain: r.chain, args: r.iptablesArgs()}
+	if rule.table != iptables.Filter {
+		rule.preArgs = []string{"-t", r.table}
+	}
+	return rule
+}
+
+// iptablesTagged renders the rule as iptables arguments with its tag added
+// to the comment, for check to find it again.
+func (r firewallRule) iptablesTagged() []string {
+	t := r
+	t.comment = strings.TrimSpace(r.comment + " " + ruleTag(strings.Join(r.iptablesArgs(), " ")))
+	return t.iptablesArgs()
+}
+
+// iptablesScriptArgs joins the arguments for iptables-restore, quoting
+// the ones with spaces.
+func iptablesScriptArgs(args []string) string {
+	quoted := make([]string, len(args))
+	for i, a := range args {
+		if strings.Contains(a, " ") {
+			a = `"` + a + `"`
 		}
-		args = []string{"-t", string(iptables.Filter), string(action), "TOR",
-			"-p", "udp",
-			"-j", "DROP"}
-		if output, err := iptables.Raw(args...); err != nil {
-			return err
-		} else if len(output) != 0 {
-			return iptables.ChainError{Chain: "FORWARD", Output: output}
+		quoted[i] = a
+	}
+	return strings.Join(quoted, " ")
+}
+
+// iptablesArgs renders the matches and target of the rule as iptables
+// arguments.
+func (r firewallRule) iptablesArgs() []string {
+	var args []string
+	iface := func(flag, name string) {
+		if strings.HasPrefix(name, "!") {
+			args = append(args, "!", flag, strings.TrimPrefix(name, "!"))
+		} else if name != "" {
+			args = append(args, flag, name)
 		}
 	}
 
-	return nil
+	iface("-i", r.in)
+	iface("-o", r.out)
+	if r.src != "" {
+		args = append(args, "-s", r.src)
+	}
+	if r.dst != "" {
+		args = append(args, "-d", r.dst)
+	}
+	if r.proto != "" {
+		args = append(args, "-p", r.proto)
+	}
+	if r.sport != "" {
+		args = append(args, "--sport", r.sport)
+	}
+	if r.dport != "" {
+		args = append(args, "--dport", r.dport)
+	}
+	if r.syn {
+		args = append(args, "--syn")
+	}
+	if r.notSyn {
+		args = append(args, "!", "--syn")
+	}
+	if r.srcLocal {
+		args = append(args, "-m", "addrtype", "--src-type", "LOCAL")
+	}
+	if len(r.ctstate) > 0 {
+		args = append(args, "-m", "conntrack", "--ctstate", strings.Join(r.ctstate, ","))
+	}
+	if r.rateAbove > 0 {
+		args = append(args, "-m", "hashlimit", "--hashlimit-above", strconv.Itoa(r.rateAbove)+"/sec",
+			"--hashlimit-burst", strconv.Itoa(r.rateBurst), "--hashlimit-name", r.rateName)
+	}
+	if r.comment != "" {
+		args = append(args, "-m", "comment", "--comment", r.comment)
+	}
+
+	args = append(args, "-j", r.target)
+	if r.toPort != "" {
+		args = append(args, "--to-ports", r.toPort)
+	}
+	if r.rejectWith != "" {
+		args = append(args, "--reject-with", r.rejectWith)
+	}
+	if r.target == "NFLOG" {
+		args = append(args, "--nflog-group", strconv.Itoa(int(r.nflogGroup)), "--nflog-prefix", r.nflogPrefix)
+	}
+	return args
 }
@@ -0,0 +1,250 @@
+package tor
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	errTooManyStreams = errors.New("too many streams")
+	errIdleTimeout    = errors.New("idle timeout")
+)
+
+// streamLimit is how many connections an endpoint may have the transparent
+// proxy relay at once, and how long those may go without data before they
+// are closed. Zero is no limit.
+type streamLimit struct {
+	max         int
+	idleTimeout time.Duration
+}
+
+// getStreamLimit parses the stream limit options, of a network or of an
+// endpoint, falling back to def for what is not set.
+func getStreamLimit(opts map[string]interface{}, def streamLimit) (streamLimit, error) {
+	l := def
+	if v, ok := getOption(opts, streamsMaxOption); ok && v != "" {
+		max, err := strconv.Atoi(v)
+		if err != nil || max < 0 {
+			return l, fmt.Errorf("Invalid %s %q", streamsMaxOption, v)
+		}
+		l.max = max
+	}
+	if v, ok := getOption(opts, streamsIdleTimeoutOption); ok && v != "" {
+		timeout, err := time.ParseDuration(v)
+		if err != nil || timeout < 0 {
+			return l, fmt.Errorf("Invalid %s %q", streamsIdleTimeoutOption, v)
+		}
+		l.idleTimeout = timeout
+	}
+	return l, nil
+}
+
+// getNetworkStreams parses how many connections the transparent proxy
+// relays at once for the whole network, and how long a connection over a
+// limit waits for a stream to free up before it is reset.
+func getNetworkStreams(opts map[string]interface{}) (int, time.Duration, error) {
+	var (
+		max   int
+		queue time.Duration
+		err   error
+	)
+	if v, ok := getOption(opts, streamsNetworkMaxOption); ok && v != "" {
+		max, err = strconv.Atoi(v)
+		if err != nil || max < 0 {
+			return 0, 0, fmt.Errorf("Invalid %s %q", streamsNetworkMaxOption, v)
+		}
+	}
+	if v, ok := getOption(opts, streamsQueueTimeoutOption); ok && v != "" {
+		queue, err = time.ParseDuration(v)
+		if err != nil || queue < 0 {
+			return 0, 0, fmt.Errorf("Invalid %s %q", streamsQueueTimeoutOption, v)
+		}
+	}
+	return max, queue, nil
+}
+
+// streamLimiter hands out the streams of the endpoints and of the network
+// the transparent proxy relays connections on.
+type streamLimiter struct {
+	// network holds a token for every stream of the network, nil without a
+	// limit
+	network chan struct{}
+	// queue is how long a connection waits for a stream, zero rejects it
+	// right away
+	queue time.Duration
+
+	sync.Mutex
+	endpoints map[string]chan struct{}
+}
+
+func newStreamLimiter(networkMax int, queue time.Duration) *streamLimiter {
+	l := &streamLimiter{queue: queue, endpoints: map[string]chan struct{}{}}
+	if networkMax > 0 {
+		l.network = make(chan struct{}, networkMax)
+	}
+	return l
+}
+
+// stream is a connection the transparent proxy relays within the limits.
+type stream struct {
+	// key is the endpoint the connection is counted towards in the
+	// metrics, or the network for addresses without one
+	key         string
+	idleTimeout time.Duration
+	release     func()
+}
+
+// acquire takes a stream of the endpoint, allowed max at once, and of the
+// network, waiting for the queue timeout if either is used up.
+func (l *streamLimiter) acquire(key, endpointID string, max int) (func(), error) {
+	var sems []chan struct{}
+	if endpointID != "" && max > 0 {
+		sems = append(sems, l.endpoint(endpointID, max))
+	}
+	if l.network != nil {
+		sems = append(sems, l.network)
+	}
+	release := func(sems []chan struct{}) {
+		for _, sem := range sems {
+			<-sem
+		}
+	}
+
+	var timeout <-chan time.Time
+	for i, sem := range sems {
+		select {
+		case sem <- struct{}{}:
+			continue
+		default:
+		}
+
+		if l.queue == 0 {
+			release(sems[:i])
+			streamsRejected.Add(key, 1)
+			return nil, errTooManyStreams
+		}
+		if timeout == nil {
+			streamsQueued.Add(key, 1)
+			timer := time.NewTimer(l.queue)
+			defer timer.Stop()
+			timeout = timer.C
+		}
+		select {
+		case sem <- struct{}{}:
+		case <-timeout:
+			release(sems[:i])
+			streamsRejected.Add(key, 1)
+			return nil, errTooManyStreams
+		}
+	}
+	return func() { release(sems) }, nil
+}
+
+// endpoint returns the tokens of the streams of the endpoint.
+func (l *streamLimiter) endpoint(endpointID string, max int) chan struct{} {
+	l.Lock()
+	defer l.Unlock()
+	sem, ok := l.endpoints[endpointID]
+	if !ok {
+		sem = make(chan struct{}, max)
+		l.endpoints[endpointID] = sem
+	}
+	return sem
+}
+
+// forget drops the streams of the endpoint once it is deleted, the
+// connections still relayed give theirs back to nobody.
+func (l *streamLimiter) forget(endpointID string) {
+	l.Lock()
+	defer l.Unlock()
+	delete(l.endpoints, endpointID)
+}
+
+// acquireStream takes a stream for a connection of the container with the
+// address.
+func (n *NetworkState) acquireStream(src net.IP) (*stream, error) {
+	s := &stream{key: n.id}
+	var (
+		endpointID string
+		limit      = n.streamLimit
+	)
+	if ep := n.endpointByIP(src); ep != nil {
+		endpointID, limit = ep.id, ep.streamLimit
+		s.key = ep.id
+	}
+	s.idleTimeout = limit.idleTimeout
+
+	release, err := n.streams.acquire(s.key, endpointID, limit.max)
+	if err != nil {
+		return nil, err
+	}
+	s.release = release
+	return s, nil
+}
+
+// idleTimer closes the two sides of a relayed connection once no data went
+// either way for the timeout.
+type idleTimer struct {
+	timeout time.Duration
+	conns   []net.Conn
+	timer   *time.Timer
+	last    int64 // unix nanoseconds of the last read, accessed atomically
+	expired int32
+}
+
+func newIdleTimer(timeout time.Duration, conns ...net.Conn) *idleTimer {
+	t := &idleTimer{timeout: timeout, conns: conns, last: time.Now().UnixNano()}
+	t.timer = time.AfterFunc(timeout, t.check)
+	return t
+}
+
+func (t *idleTimer) check() {
+	idle := time.Since(time.Unix(0, atomic.LoadInt64(&t.last)))
+	if idle < t.timeout {
+		t.timer.Reset(t.timeout - idle)
+		return
+	}
+	atomic.StoreInt32(&t.expired, 1)
+	for _, conn := range t.conns {
+		conn.Close()
+	}
+}
+
+func (t *idleTimer) stop() {
+	t.timer.Stop()
+}
+
+// timedOut returns whether the timer closed the connections.
+func (t *idleTimer) timedOut() bool {
+	return atomic.LoadInt32(&t.expired) == 1
+}
+
+// wrap returns the connection resetting the timer whenever data is read
+// from it.
+func (t *idleTimer) wrap(conn net.Conn) net.Conn {
+	return &idleConn{Conn: conn, timer: t}
+}
+
+type idleConn struct {
+	net.Conn
+	timer *idleTimer
+}
+
+func (c *idleConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		atomic.StoreInt64(&c.timer.last, time.Now().UnixNano())
+	}
+	return n, err
+}
+
+// CloseWrite half-closes the connection if it can be.
+func (c *idleConn) CloseWrite() error {
+	closeWrite(c.Conn)
+	return nil
+}
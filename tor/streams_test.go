@@ -0,0 +1,136 @@
+package tor
+
+import (
+	"expvar"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/docker/libnetwork/netlabel"
+)
+
+func TestGetStreamLimit(t *testing.T) {
+	def := streamLimit{max: 10, idleTimeout: time.Minute}
+	l, err := getStreamLimit(map[string]interface{}{netlabel.GenericData: map[string]string{
+		streamsMaxOption: "2",
+	}}, def)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := (streamLimit{max: 2, idleTimeout: time.Minute}); l != expected {
+		t.Fatalf("expected %+v, got %+v", expected, l)
+	}
+
+	for _, opts := range []map[string]string{
+		{streamsMaxOption: "-1"},
+		{streamsMaxOption: "many"},
+		{streamsIdleTimeoutOption: "5"},
+	} {
+		if _, err := getStreamLimit(map[string]interface{}{netlabel.GenericData: opts}, def); err == nil {
+			t.Errorf("expected error for %v", opts)
+		}
+	}
+
+	max, queue, err := getNetworkStreams(map[string]interface{}{netlabel.GenericData: map[string]string{
+		streamsNetworkMaxOption:   "100",
+		streamsQueueTimeoutOption: "5s",
+	}})
+	if err != nil || max != 100 || queue != 5*time.Second {
+		t.Fatalf("expected 100 streams queued for 5s, got %d, %v, %v", max, queue, err)
+	}
+}
+
+func TestStreamLimiter(t *testing.T) {
+	n := &NetworkState{
+		id:          "0123456789abcdef",
+		streamLimit: streamLimit{max: 1},
+		streams:     newStreamLimiter(2, 0),
+		endpoints: map[string]*torEndpoint{
+			"a": {id: "a", addr: &net.IPNet{IP: net.IPv4(172, 18, 0, 2)}, streamLimit: streamLimit{max: 1}},
+			"b": {id: "b", addr: &net.IPNet{IP: net.IPv4(172, 18, 0, 3)}, streamLimit: streamLimit{max: 2}},
+		},
+	}
+	a, b := net.IPv4(172, 18, 0, 2), net.IPv4(172, 18, 0, 3)
+	streamsRejected.Set("b", new(expvar.Int))
+	streamsQueued.Set("a", new(expvar.Int))
+
+	first, err := n.acquireStream(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// over the limit of the endpoint
+	if _, err := n.acquireStream(a); err != errTooManyStreams {
+		t.Fatalf("expected the second stream of a to be rejected, got %v", err)
+	}
+	if _, err := n.acquireStream(b); err != nil {
+		t.Fatal(err)
+	}
+	// over the limit of the network
+	if _, err := n.acquireStream(b); err != errTooManyStreams {
+		t.Fatalf("expected the third stream of the network to be rejected, got %v", err)
+	}
+	if v := streamsRejected.Get("b"); v == nil || v.String() != "1" {
+		t.Fatalf("expected a rejected stream of b, got %v", v)
+	}
+
+	// a queued connection gets the stream once it is released
+	n.streams.queue = time.Second
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		first.release()
+	}()
+	if _, err := n.acquireStream(a); err != nil {
+		t.Fatalf("expected the queued stream of a to get through, got %v", err)
+	}
+	if v := streamsQueued.Get("a"); v == nil || v.String() != "1" {
+		t.Fatalf("expected a queued stream of a, got %v", v)
+	}
+
+	n.streams.queue = 10 * time.Millisecond
+	if _, err := n.acquireStream(a); err != errTooManyStreams {
+		t.Fatalf("expected the queued stream of a to time out, got %v", err)
+	}
+}
+
+func TestTransparentProxyIdleTimeout(t *testing.T) {
+	socks := newFakeSOCKS5(t)
+	defer socks.listener.Close()
+	echo := echoServer(t)
+	defer echo.Close()
+
+	upstream, err := parseProxyUpstream("socks5://"+socks.listener.Addr().String(), "socks5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &transparentProxy{upstream: upstream}
+
+	client, conn := net.Pipe()
+	defer client.Close()
+	errc := make(chan error, 1)
+	go func() {
+		_, _, err := p.forward(conn, echo.Addr().String(), "", 100*time.Millisecond)
+		errc <- err
+	}()
+
+	// data going either way keeps the connection open
+	for i := 0; i < 3; i++ {
+		time.Sleep(60 * time.Millisecond)
+		if _, err := client.Write([]byte("ping")); err != nil {
+			t.Fatal(err)
+		}
+		b := make([]byte, 4)
+		if _, err := io.ReadFull(client, b); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	select {
+	case err := <-errc:
+		if err != errIdleTimeout {
+			t.Fatalf("expected the connection to time out, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the idle connection to be closed")
+	}
+}
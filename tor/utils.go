@@ -9,6 +9,7 @@ import (
 	"golang.org/x/net/context"
 
 	"github.com/docker/go-plugins-helpers/network"
+	"github.com/docker/libnetwork/netlabel"
 	"github.com/sirupsen/logrus"
 	"github.com/vishvananda/netlink"
 )
@@ -56,21 +57,10 @@ func setInterfaceIP(name string, rawIP string) error {
 	return netlink.AddrAdd(iface, addr)
 }
 
-// Create veth pair. Peername is renamed to eth0 in the container
-func vethPair(suffix string, bridgeName string) (*netlink.Veth, error) {
-	br, err := netlink.LinkByName(bridgeName)
-	if err != nil {
-		return nil, err
-	}
-
-	la := netlink.NewLinkAttrs()
-	la.Name = torPortPrefix + suffix
-	la.MasterIndex = br.Attrs().Index
-
-	return &netlink.Veth{
-		LinkAttrs: la,
-		PeerName:  "ethc" + suffix,
-	}, nil
+// Names of the veth pair of an endpoint. Peername is renamed to eth0 in the container
+func vethPair(endpointID string) (string, string) {
+	suffix := truncateID(endpointID)
+	return torPortPrefix + suffix, "ethc" + suffix
 }
 
 // Enable a netlink interface
@@ -106,6 +96,29 @@ func getBridgeName(id string, opts map[string]interface{}) (string, error) {
 	return bridgeName, nil
 }
 
+// getOption returns the string value of the option with the given key. Docker
+// passes the options given with `docker network create -o` nested under the
+// generic data label, so look there as well as at the top level.
+func getOption(opts map[string]interface{}, key string) (string, bool) {
+	if opts == nil {
+		return "", false
+	}
+	if v, ok := opts[key].(string); ok {
+		return v, true
+	}
+	if generic, ok := opts[netlabel.GenericData].(map[string]interface{}); ok {
+		if v, ok := generic[key].(string); ok {
+			return v, true
+		}
+	}
+	if generic, ok := opts[netlabel.GenericData].(map[string]string); ok {
+		if v, ok := generic[key]; ok {
+			return v, true
+		}
+	}
+	return "", false
+}
+
 func getGatewayIP(r *network.CreateNetworkRequest) (string, string, error) {
 	// FIXME: Dear future self, I'm sorry for leaving you with this mess, but I want to get this working ASAP
 	// This should be an array
@@ -0,0 +1,285 @@
+package tor
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/libnetwork/netlabel"
+	"github.com/vishvananda/netlink"
+)
+
+const (
+	verifyTimeout  = 5 * time.Second
+	verifyDNSQuery = "torproject.org"
+)
+
+// verifyReport writes the outcome of each check and remembers whether any
+// of them failed.
+type verifyReport struct {
+	w      io.Writer
+	failed bool
+}
+
+func (r *verifyReport) check(ok bool, format string, args ...interface{}) bool {
+	status := "PASS"
+	if !ok {
+		status = "FAIL"
+		r.failed = true
+	}
+	fmt.Fprintf(r.w, "  %s  %s\n", status, fmt.Sprintf(format, args...))
+	return ok
+}
+
+func (r *verifyReport) detail(format string, args ...interface{}) {
+	fmt.Fprintf(r.w, "        %s\n", fmt.Sprintf(format, args...))
+}
+
+// runtimeConfig is what the running plugin records of its settings. The
+// rules of the networks depend on them, so Verify has to rebuild the
+// networks with the same ones to know which rules to look for.
+type runtimeConfig struct {
+	FirewallBackend  string `json:"firewall_backend"`
+	LeakMonitorGroup uint16 `json:"leak_monitor_group"`
+	ProxyUpstream    string `json:"proxy_upstream,omitempty"`
+	ResolverUpstream string `json:"resolver_upstream,omitempty"`
+	I2PUpstream      string `json:"i2p_upstream,omitempty"`
+}
+
+// writeRuntimeConfig records the settings of the running plugin. The
+// upstreams might have credentials, only root can read them.
+func writeRuntimeConfig(config Config) error {
+	b, err := json.Marshal(runtimeConfig{
+		FirewallBackend:  config.FirewallBackend,
+		LeakMonitorGroup: config.LeakMonitorGroup,
+		ProxyUpstream:    config.ProxyUpstream,
+		ResolverUpstream: config.ResolverUpstream,
+		I2PUpstream:      config.I2PUpstream,
+	})
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(config.RuntimeFile, b, 0600); err != nil {
+		return fmt.Errorf("writing the runtime settings to %s failed: %v", config.RuntimeFile, err)
+	}
+	return nil
+}
+
+// readRuntimeConfig replaces the settings of the config with those of the
+// running plugin.
+func readRuntimeConfig(config Config) (Config, error) {
+	b, err := ioutil.ReadFile(config.RuntimeFile)
+	if err != nil {
+		return config, fmt.Errorf("reading the settings of the running plugin failed, is it running? %v", err)
+	}
+	var rc runtimeConfig
+	if err := json.Unmarshal(b, &rc); err != nil {
+		return config, fmt.Errorf("parsing the settings of the running plugin in %s failed: %v", config.RuntimeFile, err)
+	}
+	config.FirewallBackend = rc.FirewallBackend
+	config.LeakMonitorGroup = rc.LeakMonitorGroup
+	config.ProxyUpstream = rc.ProxyUpstream
+	config.ResolverUpstream = rc.ResolverUpstream
+	config.I2PUpstream = rc.I2PUpstream
+	return config, nil
+}
+
+// Verify checks the host and every tor network for anything that would let
+// the traffic of the containers around tor, writing what it checked to w.
+// It returns false if any of the checks failed. With a RuntimeFile the
+// networks are checked against the settings of the running plugin.
+func Verify(config Config, w io.Writer) (bool, error) {
+	if config.RuntimeFile != "" {
+		var err error
+		config, err = readRuntimeConfig(config)
+		if err != nil {
+			return false, err
+		}
+	}
+
+	d, err := newDriver(config)
+	if err != nil {
+		return false, err
+	}
+
+	networks, err := d.dcli.NetworkList(context.Background(), types.NetworkListOptions{
+		Filters: filters.NewArgs(filters.Arg("driver", "tor")),
+	})
+	if err != nil {
+		return false, fmt.Errorf("listing tor networks failed: %v", err)
+	}
+
+	r := &verifyReport{w: w}
+
+	fmt.Fprintln(w, "host")
+	d.verifyHost(r)
+
+	for _, nr := range networks {
+		fmt.Fprintf(w, "network %s (%s)\n", nr.Name, nr.ID)
+		ns, err := d.networkStateFromResource(nr)
+		if !r.check(err == nil, "network options are valid") {
+			r.detail("%v", err)
+			continue
+		}
+		ns.verify(r)
+	}
+
+	return !r.failed, nil
+}
+
+// verifyHost checks what all the networks depend on: forwarding and the tor
+// router answering on the ports the traffic is redirected to.
+func (d *Driver) verifyHost(r *verifyReport) {
+	data, err := ioutil.ReadFile(ipv4ForwardConf)
+	r.check(err == nil && len(data) > 0 && data[0] == '1', "ip forwarding is enabled")
+
+	_, err = d.getTorRouterIP()
+	if !r.check(err == nil, "tor router container %s is running", defaultTorContainer) {
+		r.detail("%v", err)
+	}
+
+	addr := net.JoinHostPort("127.0.0.1", torTransparentProxyPort)
+	what := "tor transparent proxy"
+	if d.config.ProxyUpstream != "" {
+		// newDriver made sure it parses
+		u, _ := url.Parse(d.config.ProxyUpstream)
+		addr, what = u.Host, "proxy upstream"
+	}
+	conn, err := net.DialTimeout("tcp", addr, verifyTimeout)
+	if r.check(err == nil, "%s answers on %s", what, addr) {
+		conn.Close()
+	} else {
+		r.detail("%v", err)
+	}
+
+	if d.resolverUpstream != nil {
+		e, err := newSOCKSResolver(d.resolverUpstream, "verify", nil).resolve(verifyDNSQuery)
+		if err == nil && e.rcode != 0 {
+			err = fmt.Errorf("%s did not resolve", verifyDNSQuery)
+		}
+		if !r.check(err == nil, "tor resolves through %s", d.resolverUpstream.Host) {
+			r.detail("%v", err)
+		}
+		return
+	}
+
+	upstream := &dnsServer{upstream: torDNSUpstream}
+	_, err = upstream.forward(dnsQuery(uint16(time.Now().UnixNano()), verifyDNSQuery))
+	if !r.check(err == nil, "tor dns answers on %s", torDNSUpstream) {
+		r.detail("%v", err)
+	}
+}
+
+// networkStateFromResource rebuilds the state of a network from what
+// docker knows about it.
+func (d *Driver) networkStateFromResource(nr types.NetworkResource) (*NetworkState, error) {
+	opts := map[string]interface{}{netlabel.GenericData: nr.Options}
+	ns, err := d.newNetworkState(nr.ID, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, c := range nr.IPAM.Config {
+		if c.Gateway == "" {
+			continue
+		}
+		_, subnet, err := net.ParseCIDR(c.Subnet)
+		if err != nil {
+			return nil, fmt.Errorf("invalid subnet %q: %v", c.Subnet, err)
+		}
+		ones, _ := subnet.Mask.Size()
+		ns.Gateway = c.Gateway
+		ns.GatewayMask = strconv.Itoa(ones)
+		break
+	}
+	if ns.Gateway == "" {
+		return nil, fmt.Errorf("network has no gateway")
+	}
+	// the rate limits of the endpoints can be set per endpoint, which
+	// docker does not tell, so their rules are not checked
+	ns.endpointsUnknown = true
+
+	return ns, nil
+}
+
+// verify checks the bridge and the firewall of the network.
+func (n *NetworkState) verify(r *verifyReport) {
+	l, err := netlink.LinkByName(n.BridgeName)
+	if !r.check(err == nil, "bridge %s exists", n.BridgeName) {
+		// without the bridge there is nothing to leak from
+		return
+	}
+	r.check(l.Attrs().Flags&net.FlagUp != 0, "bridge %s is up", n.BridgeName)
+
+	disabled, err := ipv6Disabled(n.BridgeName)
+	r.check(err == nil && disabled, "ipv6 is disabled on bridge %s", n.BridgeName)
+
+	fc, err := n.firewallConfig()
+	if !r.check(err == nil, "bridge %s has an address", n.BridgeName) {
+		r.detail("%v", err)
+		return
+	}
+
+	rules := fc.rules()
+	missing, err := n.firewall.check(n, rules)
+	if !r.check(err == nil && len(missing) == 0, "firewall rules are programmed") {
+		if err != nil {
+			r.detail("%v", err)
+		}
+		for _, rule := range missing {
+			r.detail("missing: %s", rule)
+		}
+	}
+
+	shadowed, err := n.firewall.shadowed(n)
+	if !r.check(err == nil && len(shadowed) == 0, "no rules let traffic through ahead of the firewall") {
+		if err != nil {
+			r.detail("%v", err)
+		}
+		for _, rule := range shadowed {
+			r.detail("ahead: %s", rule)
+		}
+	}
+
+	isMissing := map[string]bool{}
+	for _, rule := range missing {
+		isMissing[rule.String()] = true
+	}
+	blocked := func(proto string) bool {
+		for _, rule := range rules {
+			if rule.chain == "FORWARD" && rule.in == n.BridgeName && rule.proto == proto &&
+				rule.target == "DROP" && !isMissing[rule.String()] {
+				return true
+			}
+		}
+		return false
+	}
+	r.check(blocked("udp"), "udp from the containers is dropped")
+	r.check(blocked("icmp"), "icmp from the containers is dropped")
+
+	addr := net.JoinHostPort(n.Gateway, dnsProxyPort)
+	conn, err := net.DialTimeout("tcp", addr, verifyTimeout)
+	if r.check(err == nil, "dns over tcp is answered on %s", addr) {
+		conn.Close()
+	} else {
+		r.detail("%v", err)
+	}
+
+	if n.proxyUpstream != nil || n.i2pAddrs != nil {
+		addr := net.JoinHostPort(n.Gateway, proxyPort)
+		conn, err := net.DialTimeout("tcp", addr, verifyTimeout)
+		if r.check(err == nil, "transparent proxy answers on %s", addr) {
+			conn.Close()
+		} else {
+			r.detail("%v", err)
+		}
+	}
+}